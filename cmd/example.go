@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/docker/docker/api/types"
@@ -9,20 +10,54 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	osUser "os/user"
 	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 var (
 	userFlag     = flag.String("user", "", "User to own the Unix socket")
 	groupFlag    = flag.String("group", "", "Group to own the Unix socket")
 	logLevelFlag = flag.String("log-level", "info", "Log level")
+	logFormat    = flag.String("log-format", "text", "Log format of the proxy, text or json")
+
+	shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "Time to wait for connections to finish on shutdown")
+
+	maxRequestBody = flag.Int64("max-request-body", 1024*1024*1024, "Largest request body to read into memory for the filters, larger ones are refused, 0 for no limit")
+
+	upstreamFlag = flag.String("upstream", "", "Comma separated Docker daemons to forward to, like tcp://host:2376, defaults to DOCKER_HOST or the local socket")
+
+	managerFlag = flag.String("manager", "", "Swarm manager to send the swarm requests to, like tcp://manager:2376")
+
+	aggregateFlag = flag.String("aggregate", "", "Comma separated Docker daemons to list containers, images, networks and volumes from")
+
+	healthCheckInterval = flag.Duration("health-check-interval", 10*time.Second, "Time between health checks with multiple upstreams")
 
 	unixAddress = flag.String("unix", "/var/run/docker.filtered.sock", "Unix socket to listen on")
 	tcpAddress  = flag.String("tcp", ":2375", "TCP address to listen on")
 
+	metricsAddress = flag.String("metrics", "", "TCP address to serve Prometheus metrics on, disabled if empty")
+
+	auditFile       = flag.String("audit", "", "File to append the audit log of the API calls to, disabled if empty")
+	auditMaxSize    = flag.Int64("audit-max-size", 100*1024*1024, "Size of the audit log file to rotate it at")
+	auditBackups    = flag.Int("audit-backups", 5, "Number of rotated audit log files to keep")
+	auditBodiesFlag = flag.Bool("audit-bodies", false, "Include the JSON bodies, with the secrets redacted, in the audit log")
+
+	policyFile = flag.String("policy", "", "JSON or YAML policy file with the rules to filter the requests and responses with, instead of the example filters, reloaded on SIGHUP")
+
+	recordFile = flag.String("record", "", "File to append the requests and responses passing through the proxy to")
+	replayFile = flag.String("replay", "", "File recorded with -record to replay through the filters, printing the differences, instead of serving")
+
+	tlsFlag       = flag.Bool("tls", false, "Use TLS on the TCP listener; implied by -tlsverify")
+	tlsVerifyFlag = flag.Bool("tlsverify", false, "Use TLS and require client certificates signed by the CA")
+	tlsCACertFlag = flag.String("tlscacert", "", "Trust client certificates signed by this CA")
+	tlsCertFlag   = flag.String("tlscert", "", "Path to the TLS certificate file of the TCP listener")
+	tlsKeyFlag    = flag.String("tlskey", "", "Path to the TLS key file of the TCP listener")
+
 	uid, gid *int
 	logLevel = connect.LogLevel_INFO
 )
@@ -34,10 +69,73 @@ func main() {
 	// set up our example logger
 	logger := log.New(os.Stdout, "", log.LstdFlags|log.Lmicroseconds)
 
-	// create a new filtering proxy to the Docker daemon API socket
-	p := connect.NewProxy(func() (net.Conn, error) {
-		return net.Dial("unix", "/var/run/docker.sock")
-	})
+	// connect to the daemon the same way the Docker client would
+	dialer, err := connect.DialerFromEnv()
+
+	// or fail over between the given daemons
+	if *upstreamFlag != "" {
+		var upstreams []*connect.Upstream
+
+		for _, host := range strings.Split(*upstreamFlag, ",") {
+			upstreamDialer, err := connect.Dialer(host, connect.TLSOptionsFromEnv())
+			if err != nil {
+				logger.Panicln("(cli) Failed to set up the connection to", host, ":", err)
+			}
+
+			upstreams = append(upstreams, connect.NewUpstream(host, upstreamDialer))
+		}
+
+		pool := connect.NewUpstreamPool(connect.PriorityOrder(), upstreams...)
+		go pool.RunHealthChecks(context.Background(), *healthCheckInterval)
+
+		dialer, err = pool.Dial, nil
+	}
+
+	if err != nil {
+		logger.Panicln("(cli) Failed to set up the connection to the daemon:", err)
+	}
+
+	// create a new filtering proxy to the Docker daemon API
+	p := connect.NewProxy(dialer)
+	p.SetMaxRequestBodySize(*maxRequestBody)
+
+	if *logFormat == "json" {
+		p.SetLogger(connect.NewJsonLogger(os.Stdout, logLevel))
+	}
+
+	// record the API calls and the decisions of the filters
+	if *auditFile != "" {
+		sink, err := connect.NewAuditFileSink(*auditFile, *auditMaxSize, *auditBackups)
+		if err != nil {
+			logger.Panicln("(cli) Failed to open the audit log:", err)
+		}
+		defer sink.Close()
+
+		p.Audit(sink, connect.AuditOptions{CaptureBodies: *auditBodiesFlag})
+	}
+
+	// record the traffic to replay it later against changed filters
+	if *recordFile != "" {
+		recording, err := os.OpenFile(*recordFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			logger.Panicln("(cli) Failed to open the recording:", err)
+		}
+		defer recording.Close()
+
+		p.Record(recording)
+	}
+
+	// send the swarm requests to the manager if there is one
+	if *managerFlag != "" {
+		managerDialer, err := connect.Dialer(*managerFlag, connect.TLSOptionsFromEnv())
+		if err != nil {
+			logger.Panicln("(cli) Failed to set up the connection to the manager:", err)
+		}
+
+		p.Route("manager",
+			connect.RouteByPathPrefix("/swarm", "/services", "/tasks", "/nodes", "/secrets", "/configs"),
+			managerDialer)
+	}
 
 	// set up a unix socket listener
 	if unixAddress != nil {
@@ -63,14 +161,146 @@ func main() {
 		tcpListener, err := net.Listen("tcp", *tcpAddress)
 		if err != nil {
 			logger.Println("(cli) Failed to bind to the TCP socket:", err)
+		} else if *tlsFlag || *tlsVerifyFlag {
+			tlsConfig, err := connect.ServerTLSConfig(connect.TLSOptions{
+				CAFile:   *tlsCACertFlag,
+				CertFile: *tlsCertFlag,
+				KeyFile:  *tlsKeyFlag,
+				Verify:   *tlsVerifyFlag,
+			})
+			if err != nil {
+				logger.Panicln("(cli) Failed to set up TLS:", err)
+			}
+
+			p.AddTLSListener("", tcpListener, tlsConfig)
+			defer tcpListener.Close()
 		} else {
 			p.AddListener("", tcpListener)
 			defer tcpListener.Close()
 		}
 	}
 
+	// list the resources of several daemons together
+	if *aggregateFlag != "" {
+		var upstreams []*connect.Upstream
+
+		for _, host := range strings.Split(*aggregateFlag, ",") {
+			upstreamDialer, err := connect.Dialer(host, connect.TLSOptionsFromEnv())
+			if err != nil {
+				logger.Panicln("(cli) Failed to set up the connection to", host, ":", err)
+			}
+
+			upstreams = append(upstreams, connect.NewUpstream(host, upstreamDialer))
+		}
+
+		// the lists are fetched after the filters, and kept when the policy is reloaded
+		for _, path := range []string{"/containers/json", "/images/json", "/networks", "/volumes"} {
+			p.Aggregate(path, upstreams...)
+		}
+	}
+
+	// expose the metrics of the proxy
+	if *metricsAddress != "" {
+		metricsListener, err := net.Listen("tcp", *metricsAddress)
+		if err != nil {
+			logger.Println("(cli) Failed to bind to the metrics address:", err)
+		} else {
+			go p.ServeMetrics(metricsListener)
+			defer metricsListener.Close()
+		}
+	}
+
+	// load the filters from the policy file, or use the example ones
+	if *policyFile != "" {
+		policy, err := connect.LoadPolicy(*policyFile)
+		if err != nil {
+			logger.Panicln("(cli) Failed to load the policy:", err)
+		}
+
+		p.ApplyPolicy(policy)
+	} else {
+		registerExampleFilters(p, logger)
+	}
+
+	// compare the decisions of the filters to a recording, without serving any requests
+	if *replayFile != "" {
+		recording, err := os.Open(*replayFile)
+		if err != nil {
+			logger.Panicln("(cli) Failed to open the recording:", err)
+		}
+		defer recording.Close()
+
+		report, err := p.Replay(recording)
+		if err != nil {
+			logger.Panicln("(cli) Failed to replay the recording:", err)
+		}
+
+		for _, result := range report.Results {
+			for _, difference := range result.Differences {
+				fmt.Println(result.Recorded.RequestID, result.Recorded.Request.Method, result.Recorded.Request.URL, "-", difference)
+			}
+		}
+
+		fmt.Println("Replayed", len(report.Results), "requests,", report.Changed, "with differences")
+		return
+	}
+
+	// stop accepting requests on SIGINT or SIGTERM
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	// reload the policy on SIGHUP, without closing the connections
+	if *policyFile != "" {
+		loadPolicy := func(p *connect.Proxy) error {
+			policy, err := connect.LoadPolicy(*policyFile)
+			if err != nil {
+				return err
+			}
+
+			p.ApplyPolicy(policy)
+			return nil
+		}
+
+		reloads := make(chan os.Signal, 1)
+		signal.Notify(reloads, syscall.SIGHUP)
+		go func() {
+			for range reloads {
+				if err := p.ReloadHandlers(loadPolicy); err != nil {
+					logger.Println("(cli) Failed to reload the policy, keeping the previous one:", err)
+				} else {
+					logger.Println("(cli) Reloaded the policy from", *policyFile)
+				}
+			}
+		}()
+	}
+
+	// start accepting requests
+	if err := p.Process(ctx); err != context.Canceled {
+		logger.Panicln(err)
+	}
+
+	// let the in-flight requests finish
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancelShutdown()
+
+	if drained, err := p.Shutdown(shutdownCtx); err != nil {
+		logger.Println("(cli) Closed connections forcibly on shutdown after draining", drained, ":", err)
+	} else {
+		logger.Println("(cli) Drained", drained, "connections on shutdown")
+	}
+
+	// ... try requests with `docker -H localhost version`
+}
+
+func registerExampleFilters(p *connect.Proxy, logger *log.Logger) {
 	// register a filter to add labels to new containers
-	p.FilterRequests("/containers/create",
+	p.On("POST", "/containers/create",
 		connect.FilterRequestAsJson(
 			func() connect.T { return new(map[string]interface{}) },
 			func(req connect.T) connect.T {
@@ -118,7 +348,7 @@ func main() {
 		return nil, nil
 	})
 
-	p.FilterResponses(".*/containers/json",
+	p.OnResponse("GET", "/containers/json",
 		connect.FilterResponseAsJson(
 			func() connect.T { return &[]types.Container{} },
 			func(resp connect.T) connect.T {
@@ -133,11 +363,6 @@ func main() {
 
 				return cs
 			}))
-
-	// start accepting requests
-	logger.Panicln(p.Process())
-
-	// ... try requests with `docker -H localhost version`
 }
 
 func init() {
@@ -10,4 +10,5 @@ require (
 	github.com/opencontainers/image-spec v1.0.1 // indirect
 	github.com/pkg/errors v0.8.0 // indirect
 	golang.org/x/net v0.0.0-20181029044818-c44066c5c816 // indirect
+	gopkg.in/yaml.v2 v2.4.0
 )
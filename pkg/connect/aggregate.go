@@ -0,0 +1,206 @@
+package connect
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// SourceLabel is added to the labels of the items in aggregated lists, with the name of the upstream they came from.
+const SourceLabel = "com.rycus86.docker-filter.source"
+
+const (
+	aggregateTimeout     = 30 * time.Second
+	aggregateIdleTimeout = 90 * time.Second
+)
+
+// Aggregate answers GET requests for a read-only list endpoint, like /containers/json or /volumes,
+// by sending them to every upstream and merging the JSON lists in their responses, with the
+// SourceLabel added to each item. The lists are fetched after every request filter has run, in place
+// of sending the request to the upstream it would be routed to, so the request filters can still deny
+// or change the requests, and the response filters of the endpoint see the merged list.
+// Upstreams that fail to respond are left out, and the request fails only if all of them do.
+// Like the routes, the aggregated endpoints are kept when the filters are reloaded.
+func (p *Proxy) Aggregate(pathTemplate string, upstreams ...*Upstream) {
+	clients := make([]*http.Client, len(upstreams))
+	for idx, upstream := range upstreams {
+		clients[idx] = upstream.httpClient()
+	}
+
+	p.aggregates = append(p.aggregates, &aggregatedList{
+		match:     RouteByPath("GET", pathTemplate),
+		upstreams: upstreams,
+		clients:   clients,
+	})
+}
+
+func (p *Proxy) aggregateFor(request *http.Request) *aggregatedList {
+	for _, list := range p.aggregates {
+		if list.match(request) {
+			return list
+		}
+	}
+
+	return nil
+}
+
+// fetchAggregated sends the request to every upstream of the list, and returns the response with the merged lists.
+func (cp *connectionPair) fetchAggregated(list *aggregatedList, req *http.Request) *http.Response {
+	results := make([]interface{}, len(list.upstreams))
+	failures := make([]error, len(list.upstreams))
+
+	done := make(chan struct{})
+	for idx := range list.upstreams {
+		go func(idx int) {
+			defer func() { done <- struct{}{} }()
+			results[idx], failures[idx] = fetchList(list.clients[idx], req)
+		}(idx)
+	}
+	for range list.upstreams {
+		<-done
+	}
+
+	var merged interface{}
+	for idx, upstream := range list.upstreams {
+		if failures[idx] != nil {
+			cp.logFields(LogLevel_WARN, Fields{"upstream": upstream.Name, "request_id": ContextOf(req).RequestID, "path": req.URL.Path},
+				"Failed to list", req.URL.Path, "on", upstream.Name, ":", failures[idx])
+			continue
+		}
+
+		var err error
+		if merged, err = mergeList(merged, results[idx], upstream.Name); err != nil {
+			return NewDenial(http.StatusBadGateway, "Failed to merge the lists of "+req.URL.Path+": "+err.Error()).toResponse()
+		}
+	}
+
+	if merged == nil {
+		return NewDenial(http.StatusBadGateway, "Failed to list "+req.URL.Path+" on any of the upstreams").toResponse()
+	}
+
+	return NewJsonResponse(http.StatusOK, merged)
+}
+
+// httpClient returns the client of the upstream for aggregated requests, shared by every
+// endpoint, so that the idle connections to it are reused, and closed after a while.
+func (u *Upstream) httpClient() *http.Client {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if u.client == nil {
+		u.client = &http.Client{
+			Timeout: aggregateTimeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return u.Dialer()
+				},
+				IdleConnTimeout: aggregateIdleTimeout,
+			},
+		}
+	}
+
+	return u.client
+}
+
+func fetchList(client *http.Client, req *http.Request) (interface{}, error) {
+	request, err := http.NewRequest("GET", "http://docker"+req.URL.RequestURI(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range []string{"Accept", "User-Agent", "Authorization"} {
+		if value := req.Header.Get(name); value != "" {
+			request.Header.Set(name, value)
+		}
+	}
+
+	response, err := client.Do(request.WithContext(req.Context()))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d: %s", response.StatusCode, bytes.TrimSpace(body))
+	}
+
+	var list interface{}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber() // keep sizes and timestamps as they are
+
+	if err := decoder.Decode(&list); err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// mergeList appends the items of a list response to the merged one, which are either
+// JSON arrays, or objects with arrays in them, like the response of /volumes.
+func mergeList(merged, list interface{}, source string) (interface{}, error) {
+	switch items := list.(type) {
+	case []interface{}:
+		if merged == nil {
+			merged = []interface{}{}
+		}
+
+		mergedItems, ok := merged.([]interface{})
+		if !ok {
+			return nil, errors.New("the upstreams responded with different types of lists")
+		}
+
+		return append(mergedItems, labelSources(items, source)...), nil
+
+	case map[string]interface{}:
+		if merged == nil {
+			merged = map[string]interface{}{}
+		}
+
+		mergedFields, ok := merged.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("the upstreams responded with different types of lists")
+		}
+
+		for key, value := range items {
+			if values, ok := value.([]interface{}); ok {
+				existing, _ := mergedFields[key].([]interface{})
+				mergedFields[key] = append(existing, labelSources(values, source)...)
+			} else if mergedFields[key] == nil {
+				mergedFields[key] = value
+			}
+		}
+
+		return mergedFields, nil
+
+	default:
+		return nil, fmt.Errorf("unexpected list response from %s", source)
+	}
+}
+
+func labelSources(items []interface{}, source string) []interface{} {
+	for _, item := range items {
+		if fields, ok := item.(map[string]interface{}); ok {
+			labels, _ := fields["Labels"].(map[string]interface{})
+			if labels == nil {
+				labels = map[string]interface{}{}
+			}
+
+			labels[SourceLabel] = source
+			fields["Labels"] = labels
+		}
+	}
+
+	return items
+}
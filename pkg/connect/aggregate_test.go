@@ -0,0 +1,125 @@
+package connect
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/volume"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAggregateListEndpoints(t *testing.T) {
+	SetLogLevel(LogLevel_ERROR)
+
+	startDaemon := func(containers string, volumes string) (*httptest.Server, *Upstream) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			switch r.URL.Path {
+			case "/v1.40/containers/json":
+				if r.URL.Query().Get("all") != "1" {
+					w.WriteHeader(http.StatusBadRequest)
+				}
+				w.Write([]byte(containers))
+			case "/volumes":
+				w.Write([]byte(volumes))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+
+		return server, NewUpstream(server.URL, func() (net.Conn, error) {
+			return net.Dial("tcp", server.Listener.Addr().String())
+		})
+	}
+
+	first, firstUpstream := startDaemon(
+		`[{"Id":"c1","Names":["/web"],"Labels":{"app":"web"},"SizeRw":12345678901234}]`,
+		`{"Volumes":[{"Name":"data","Labels":null}],"Warnings":null}`)
+	defer first.Close()
+
+	second, secondUpstream := startDaemon(
+		`[{"Id":"c2","Names":["/db"]},{"Id":"c3","Names":["/cache"]}]`,
+		`{"Volumes":[{"Name":"logs"}],"Warnings":["slow driver"]}`)
+	defer second.Close()
+
+	offline, offlineUpstream := startDaemon("", "")
+	offline.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen:", err)
+	}
+	defer listener.Close()
+
+	proxy := NewProxy(func() (net.Conn, error) {
+		return net.Dial("tcp", first.Listener.Addr().String())
+	})
+	proxy.AddListener("", listener)
+
+	proxy.Aggregate("/containers/json", firstUpstream, offlineUpstream, secondUpstream)
+	proxy.Aggregate("/volumes", firstUpstream, secondUpstream)
+
+	proxy.OnResponse("GET", "/containers/json", FilterResponseAsJson(
+		func() T { return &[]types.Container{} },
+		func(resp T) T {
+			cs := *resp.(*[]types.Container)
+			for idx := range cs {
+				cs[idx].Image = "redacted"
+			}
+			return cs
+		}))
+
+	go proxy.Process(context.Background())
+
+	var containers []types.Container
+	getJson(t, "http://"+listener.Addr().String()+"/v1.40/containers/json?all=1", &containers)
+
+	if len(containers) != 3 {
+		t.Fatal("Unexpected containers:", containers)
+	}
+	for idx, source := range []string{first.URL, second.URL, second.URL} {
+		if containers[idx].Labels[SourceLabel] != source || containers[idx].Image != "redacted" {
+			t.Errorf("Unexpected container: %+v", containers[idx])
+		}
+	}
+	if containers[0].Labels["app"] != "web" || containers[0].SizeRw != 12345678901234 {
+		t.Errorf("Expected the original fields to be kept: %+v", containers[0])
+	}
+
+	var volumes volume.VolumesListOKBody
+	getJson(t, "http://"+listener.Addr().String()+"/volumes", &volumes)
+
+	if len(volumes.Volumes) != 2 || volumes.Volumes[1].Labels[SourceLabel] != second.URL {
+		t.Errorf("Unexpected volumes: %+v", volumes.Volumes)
+	}
+	if len(volumes.Warnings) != 1 || volumes.Warnings[0] != "slow driver" {
+		t.Error("Unexpected warnings:", volumes.Warnings)
+	}
+
+	// the endpoints share the idle connections to the same upstream
+	if client := firstUpstream.httpClient(); client != firstUpstream.httpClient() || client == secondUpstream.httpClient() {
+		t.Error("Expected one client for each upstream")
+	} else if client.Transport.(*http.Transport).IdleConnTimeout <= 0 {
+		t.Error("Expected the idle connections to time out")
+	}
+}
+
+func getJson(t *testing.T, url string, v interface{}) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal("Failed to send the request:", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("Unexpected response:", resp.Status)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatal("Failed to decode the response:", err)
+	}
+}
@@ -0,0 +1,534 @@
+package connect
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultAuditBodySize = 64 * 1024
+
+// DefaultRedactedFields are the JSON fields replaced in the captured bodies when the options do not list any.
+// The values of the variables in lists of NAME=value strings, like Env, are replaced, keeping their names.
+var DefaultRedactedFields = []string{
+	"password", "secret", "token", "identitytoken", "registrytoken", "auth", "data", "env",
+}
+
+// AuditRecord describes a single exchange between a client and the proxy.
+// Status is the one sent to the client, while UpstreamStatus is the one the upstream responded with,
+// before the response filters, and it is empty when the proxy answered the request itself.
+type AuditRecord struct {
+	Time           time.Time        `json:"time"`
+	RequestID      string           `json:"request_id"`
+	Listener       string           `json:"listener"`
+	ConnectionID   int              `json:"connection_id"`
+	RemoteAddr     string           `json:"remote_addr,omitempty"`
+	Client         *AuditClient     `json:"client,omitempty"`
+	Method         string           `json:"method"`
+	Path           string           `json:"path"`
+	Query          string           `json:"query,omitempty"`
+	Operation      string           `json:"operation"`
+	Decisions      []FilterDecision `json:"decisions"`
+	Upstream       string           `json:"upstream,omitempty"`
+	UpstreamStatus int              `json:"upstream_status,omitempty"`
+	Status         int              `json:"status"`
+	Error          string           `json:"error,omitempty"`
+	DurationMs     float64          `json:"duration_ms"`
+	RequestSize    int              `json:"request_size"`
+	ResponseSize   int              `json:"response_size"`
+	RequestBody    json.RawMessage  `json:"request_body,omitempty"`
+	ResponseBody   json.RawMessage  `json:"response_body,omitempty"`
+}
+
+// AuditClient is the identity of the client in an AuditRecord, see ClientIdentity.
+type AuditClient struct {
+	Uid        *int     `json:"uid,omitempty"`
+	Gid        *int     `json:"gid,omitempty"`
+	Pid        *int     `json:"pid,omitempty"`
+	Subject    string   `json:"subject,omitempty"`
+	CommonName string   `json:"common_name,omitempty"`
+	SANs       []string `json:"sans,omitempty"`
+}
+
+// FilterDecision is the outcome of a request or response filter on an exchange:
+// passed, modified, soft_failure, critical_failure, denied or direct_response.
+type FilterDecision struct {
+	Kind    string `json:"kind"`
+	Handler string `json:"handler"`
+	Outcome string `json:"outcome"`
+}
+
+// AuditSink receives the audit records of a proxy, one per exchange, in the order they complete.
+type AuditSink interface {
+	Record(record *AuditRecord) error
+}
+
+// AuditOptions configure what the audit records contain.
+type AuditOptions struct {
+	// CaptureBodies adds the JSON request and response bodies to the records
+	CaptureBodies bool
+	// MaxBodySize is the size above which the bodies are not captured, 64 KiB by default
+	MaxBodySize int
+	// RedactFields are the JSON fields (in any object, case insensitive) to replace, DefaultRedactedFields by default
+	RedactFields []string
+}
+
+type auditor struct {
+	sink    AuditSink
+	options AuditOptions
+	redact  fieldRedactor
+}
+
+// Audit sends a record of every exchange to the sink, after the response is sent to the client.
+func (p *Proxy) Audit(sink AuditSink, options AuditOptions) {
+	if options.MaxBodySize == 0 {
+		options.MaxBodySize = defaultAuditBodySize
+	}
+	if options.RedactFields == nil {
+		options.RedactFields = DefaultRedactedFields
+	}
+
+	p.auditor = &auditor{sink: sink, options: options, redact: newFieldRedactor(options.RedactFields)}
+}
+
+func (cp *connectionPair) audit(ex *exchange, response *http.Response, responseBody []byte, failure error) {
+	a := cp.proxy.auditor
+	if a == nil {
+		return
+	}
+
+	rc := ContextOf(ex.request)
+
+	record := &AuditRecord{
+		Time:           ex.started,
+		RequestID:      rc.RequestID,
+		Listener:       rc.Listener,
+		ConnectionID:   rc.ConnectionID,
+		RemoteAddr:     rc.RemoteAddr,
+		Client:         auditClientOf(rc.Client),
+		Method:         ex.request.Method,
+		Path:           ex.request.URL.Path,
+		Query:          ex.request.URL.RawQuery,
+		Operation:      OperationOf(ex.request),
+		Decisions:      ex.decisions,
+		Upstream:       rc.Upstream,
+		UpstreamStatus: ex.upstreamStatus,
+		DurationMs:     float64(time.Since(ex.started)) / float64(time.Millisecond),
+		RequestSize:    len(ex.requestBody),
+		ResponseSize:   len(responseBody),
+	}
+
+	if record.Decisions == nil {
+		record.Decisions = []FilterDecision{}
+	}
+	if response != nil {
+		record.Status = response.StatusCode
+	}
+	if failure != nil {
+		record.Error = failure.Error()
+	}
+
+	if a.options.CaptureBodies {
+		record.RequestBody = a.capture(ex.requestBody)
+		record.ResponseBody = a.capture(responseBody)
+	}
+
+	if err := a.sink.Record(record); err != nil {
+		cp.error("Failed to record the audit entry of", ex.request.URL, ":", err)
+	}
+}
+
+func auditClientOf(client *ClientIdentity) *AuditClient {
+	if client == nil || client.Credentials == nil && client.Certificate == nil {
+		return nil
+	}
+
+	audited := &AuditClient{Subject: client.Subject, CommonName: client.CommonName, SANs: client.SANs}
+	if creds := client.Credentials; creds != nil {
+		audited.Uid, audited.Gid, audited.Pid = &creds.Uid, &creds.Gid, &creds.Pid
+	}
+
+	return audited
+}
+
+// capture returns the redacted JSON body, or nothing for bodies that are too large or not JSON.
+func (a *auditor) capture(body []byte) json.RawMessage {
+	if len(body) == 0 || len(body) > a.options.MaxBodySize {
+		return nil
+	}
+
+	var v interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	if decoder.Decode(&v) != nil {
+		return nil
+	}
+
+	redacted, err := json.Marshal(a.redact.redactValue(v))
+	if err != nil {
+		return nil
+	}
+
+	return redacted
+}
+
+// fieldRedactor replaces the values of the JSON fields it lists, in lower case.
+type fieldRedactor map[string]bool
+
+func newFieldRedactor(fields []string) fieldRedactor {
+	redact := fieldRedactor{}
+	for _, field := range fields {
+		redact[strings.ToLower(field)] = true
+	}
+
+	return redact
+}
+
+func (r fieldRedactor) redactValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for key, field := range value {
+			if r[strings.ToLower(key)] && field != nil && field != "" {
+				value[key] = redactedValueOf(field)
+			} else {
+				value[key] = r.redactValue(field)
+			}
+		}
+	case []interface{}:
+		for idx, item := range value {
+			value[idx] = r.redactValue(item)
+		}
+	}
+
+	return v
+}
+
+func redactedValueOf(field interface{}) interface{} {
+	variables, ok := field.([]interface{})
+	if !ok {
+		return "***"
+	}
+
+	redacted := make([]interface{}, len(variables))
+	for idx, variable := range variables {
+		if text, ok := variable.(string); ok && strings.Contains(text, "=") {
+			redacted[idx] = text[:strings.Index(text, "=")+1] + "***"
+		} else {
+			redacted[idx] = "***"
+		}
+	}
+
+	return redacted
+}
+
+func filterOutcome(changed bool, err error) string {
+	switch err.(type) {
+	case nil:
+		if changed {
+			return "modified"
+		}
+		return "passed"
+	case SoftFailure:
+		return "soft_failure"
+	case CriticalFailure:
+		return "critical_failure"
+	case Denial:
+		return "denied"
+	case DirectResponse:
+		return "direct_response"
+	}
+
+	if err == DropChunk {
+		return "dropped"
+	}
+
+	return "passed"
+}
+
+func (h *handler) decision(kind string, changed bool, err error) FilterDecision {
+	method := h.method
+	if method == "" {
+		method = "*"
+	}
+
+	return FilterDecision{Kind: kind, Handler: method + " " + h.path, Outcome: filterOutcome(changed, err)}
+}
+
+// AuditWriterSink writes the audit records to a writer as newline-delimited JSON.
+type AuditWriterSink struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+func NewAuditWriterSink(w io.Writer) *AuditWriterSink {
+	return &AuditWriterSink{w: w}
+}
+
+func (s *AuditWriterSink) Record(record *AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
+
+// AuditFileSink appends the audit records to a file as newline-delimited JSON, and rotates it
+// when it would grow over the maximum size, keeping the given number of older files as path.1, path.2 and so on.
+type AuditFileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+func NewAuditFileSink(path string, maxSize int64, maxBackups int) (*AuditFileSink, error) {
+	sink := &AuditFileSink{path: path, maxSize: maxSize, maxBackups: maxBackups}
+
+	if err := sink.open(); err != nil {
+		return nil, err
+	}
+
+	return sink, nil
+}
+
+func (s *AuditFileSink) Record(record *AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.file == nil {
+		return os.ErrClosed
+	}
+
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+
+	return err
+}
+
+func (s *AuditFileSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+
+	err := s.file.Close()
+	s.file = nil
+
+	return err
+}
+
+func (s *AuditFileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	s.file, s.size = file, info.Size()
+	return nil
+}
+
+func (s *AuditFileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.file = nil
+
+	if s.maxBackups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", s.path, s.maxBackups))
+
+		for idx := s.maxBackups - 1; idx > 0; idx-- {
+			os.Rename(fmt.Sprintf("%s.%d", s.path, idx), fmt.Sprintf("%s.%d", s.path, idx+1))
+		}
+
+		if err := os.Rename(s.path, s.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(s.path); err != nil {
+		return err
+	}
+
+	return s.open()
+}
+
+type operation struct {
+	method  string
+	pattern *regexp.Regexp
+	name    string
+}
+
+func newOperation(method, pathTemplate, name string) operation {
+	return operation{method: method, pattern: CompilePathTemplate(pathTemplate), name: name}
+}
+
+// operations name the Engine API endpoints, the more specific templates first.
+var operations = []operation{
+	newOperation("GET", "/_ping", "SystemPing"),
+	newOperation("HEAD", "/_ping", "SystemPing"),
+	newOperation("GET", "/version", "SystemVersion"),
+	newOperation("GET", "/info", "SystemInfo"),
+	newOperation("GET", "/events", "SystemEvents"),
+	newOperation("GET", "/system/df", "SystemDataUsage"),
+	newOperation("POST", "/auth", "SystemAuth"),
+
+	newOperation("GET", "/containers/json", "ContainerList"),
+	newOperation("POST", "/containers/create", "ContainerCreate"),
+	newOperation("POST", "/containers/prune", "ContainerPrune"),
+	newOperation("GET", "/containers/{id}/json", "ContainerInspect"),
+	newOperation("GET", "/containers/{id}/top", "ContainerTop"),
+	newOperation("GET", "/containers/{id}/logs", "ContainerLogs"),
+	newOperation("GET", "/containers/{id}/changes", "ContainerChanges"),
+	newOperation("GET", "/containers/{id}/export", "ContainerExport"),
+	newOperation("GET", "/containers/{id}/stats", "ContainerStats"),
+	newOperation("POST", "/containers/{id}/resize", "ContainerResize"),
+	newOperation("POST", "/containers/{id}/start", "ContainerStart"),
+	newOperation("POST", "/containers/{id}/stop", "ContainerStop"),
+	newOperation("POST", "/containers/{id}/restart", "ContainerRestart"),
+	newOperation("POST", "/containers/{id}/kill", "ContainerKill"),
+	newOperation("POST", "/containers/{id}/update", "ContainerUpdate"),
+	newOperation("POST", "/containers/{id}/rename", "ContainerRename"),
+	newOperation("POST", "/containers/{id}/pause", "ContainerPause"),
+	newOperation("POST", "/containers/{id}/unpause", "ContainerUnpause"),
+	newOperation("POST", "/containers/{id}/attach", "ContainerAttach"),
+	newOperation("GET", "/containers/{id}/attach/ws", "ContainerAttachWebsocket"),
+	newOperation("POST", "/containers/{id}/wait", "ContainerWait"),
+	newOperation("DELETE", "/containers/{id}", "ContainerDelete"),
+	newOperation("HEAD", "/containers/{id}/archive", "ContainerArchiveInfo"),
+	newOperation("GET", "/containers/{id}/archive", "ContainerArchive"),
+	newOperation("PUT", "/containers/{id}/archive", "PutContainerArchive"),
+	newOperation("POST", "/containers/{id}/exec", "ContainerExec"),
+	newOperation("POST", "/exec/{id}/start", "ExecStart"),
+	newOperation("POST", "/exec/{id}/resize", "ExecResize"),
+	newOperation("GET", "/exec/{id}/json", "ExecInspect"),
+
+	newOperation("GET", "/images/json", "ImageList"),
+	newOperation("POST", "/build", "ImageBuild"),
+	newOperation("POST", "/build/prune", "BuildPrune"),
+	newOperation("POST", "/images/create", "ImageCreate"),
+	newOperation("POST", "/images/load", "ImageLoad"),
+	newOperation("GET", "/images/get", "ImageGetAll"),
+	newOperation("GET", "/images/search", "ImageSearch"),
+	newOperation("POST", "/images/prune", "ImagePrune"),
+	newOperation("POST", "/commit", "ImageCommit"),
+	newOperation("GET", "/images/{name:.+}/json", "ImageInspect"),
+	newOperation("GET", "/images/{name:.+}/history", "ImageHistory"),
+	newOperation("GET", "/images/{name:.+}/get", "ImageGet"),
+	newOperation("POST", "/images/{name:.+}/push", "ImagePush"),
+	newOperation("POST", "/images/{name:.+}/tag", "ImageTag"),
+	newOperation("DELETE", "/images/{name:.+}", "ImageDelete"),
+	newOperation("GET", "/distribution/{name:.+}/json", "DistributionInspect"),
+
+	newOperation("GET", "/networks", "NetworkList"),
+	newOperation("POST", "/networks/create", "NetworkCreate"),
+	newOperation("POST", "/networks/prune", "NetworkPrune"),
+	newOperation("GET", "/networks/{id}", "NetworkInspect"),
+	newOperation("DELETE", "/networks/{id}", "NetworkDelete"),
+	newOperation("POST", "/networks/{id}/connect", "NetworkConnect"),
+	newOperation("POST", "/networks/{id}/disconnect", "NetworkDisconnect"),
+
+	newOperation("GET", "/volumes", "VolumeList"),
+	newOperation("POST", "/volumes/create", "VolumeCreate"),
+	newOperation("POST", "/volumes/prune", "VolumePrune"),
+	newOperation("GET", "/volumes/{name}", "VolumeInspect"),
+	newOperation("DELETE", "/volumes/{name}", "VolumeDelete"),
+
+	newOperation("GET", "/swarm", "SwarmInspect"),
+	newOperation("POST", "/swarm/init", "SwarmInit"),
+	newOperation("POST", "/swarm/join", "SwarmJoin"),
+	newOperation("POST", "/swarm/leave", "SwarmLeave"),
+	newOperation("POST", "/swarm/update", "SwarmUpdate"),
+	newOperation("GET", "/swarm/unlockkey", "SwarmUnlockkey"),
+	newOperation("POST", "/swarm/unlock", "SwarmUnlock"),
+	newOperation("GET", "/nodes", "NodeList"),
+	newOperation("GET", "/nodes/{id}", "NodeInspect"),
+	newOperation("DELETE", "/nodes/{id}", "NodeDelete"),
+	newOperation("POST", "/nodes/{id}/update", "NodeUpdate"),
+	newOperation("GET", "/services", "ServiceList"),
+	newOperation("POST", "/services/create", "ServiceCreate"),
+	newOperation("GET", "/services/{id}", "ServiceInspect"),
+	newOperation("DELETE", "/services/{id}", "ServiceDelete"),
+	newOperation("POST", "/services/{id}/update", "ServiceUpdate"),
+	newOperation("GET", "/services/{id}/logs", "ServiceLogs"),
+	newOperation("GET", "/tasks", "TaskList"),
+	newOperation("GET", "/tasks/{id}", "TaskInspect"),
+	newOperation("GET", "/tasks/{id}/logs", "TaskLogs"),
+	newOperation("GET", "/secrets", "SecretList"),
+	newOperation("POST", "/secrets/create", "SecretCreate"),
+	newOperation("GET", "/secrets/{id}", "SecretInspect"),
+	newOperation("DELETE", "/secrets/{id}", "SecretDelete"),
+	newOperation("POST", "/secrets/{id}/update", "SecretUpdate"),
+	newOperation("GET", "/configs", "ConfigList"),
+	newOperation("POST", "/configs/create", "ConfigCreate"),
+	newOperation("GET", "/configs/{id}", "ConfigInspect"),
+	newOperation("DELETE", "/configs/{id}", "ConfigDelete"),
+	newOperation("POST", "/configs/{id}/update", "ConfigUpdate"),
+
+	newOperation("GET", "/plugins", "PluginList"),
+	newOperation("GET", "/plugins/privileges", "GetPluginPrivileges"),
+	newOperation("POST", "/plugins/pull", "PluginPull"),
+	newOperation("POST", "/plugins/create", "PluginCreate"),
+	newOperation("GET", "/plugins/{name:.+}/json", "PluginInspect"),
+	newOperation("POST", "/plugins/{name:.+}/enable", "PluginEnable"),
+	newOperation("POST", "/plugins/{name:.+}/disable", "PluginDisable"),
+	newOperation("POST", "/plugins/{name:.+}/upgrade", "PluginUpgrade"),
+	newOperation("POST", "/plugins/{name:.+}/push", "PluginPush"),
+	newOperation("POST", "/plugins/{name:.+}/set", "PluginSet"),
+	newOperation("DELETE", "/plugins/{name:.+}", "PluginDelete"),
+
+	newOperation("POST", "/session", "Session"),
+}
+
+// OperationOf returns the name of the Engine API operation of the request, like ContainerCreate
+// or ImageBuild, or the method and path of the request if it is not a known one.
+func OperationOf(req *http.Request) string {
+	if name, ok := knownOperation(req); ok {
+		return name
+	}
+
+	return req.Method + " " + req.URL.Path
+}
+
+func knownOperation(req *http.Request) (string, bool) {
+	for _, op := range operations {
+		if op.method == req.Method && op.pattern.MatchString(req.URL.Path) {
+			return op.name, true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,180 @@
+package connect
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	SetLogLevel(LogLevel_ERROR)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"Status":"Login Succeeded","IdentityToken":"abc"}`))
+	}))
+	defer server.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen:", err)
+	}
+	defer listener.Close()
+
+	proxy := NewProxy(func() (net.Conn, error) {
+		return net.Dial("tcp", server.Listener.Addr().String())
+	})
+	proxy.AddListener("", listener)
+
+	output := &lockedBuffer{}
+	proxy.Audit(NewAuditWriterSink(output), AuditOptions{CaptureBodies: true})
+
+	proxy.On("*", "/auth", func(req *http.Request, body []byte) (*http.Request, error) {
+		return nil, nil
+	})
+	proxy.On("POST", "/containers/create", func(req *http.Request, body []byte) (*http.Request, error) {
+		return nil, NewDenial(http.StatusForbidden, "not allowed")
+	})
+	proxy.OnResponse("POST", "/auth", func(resp *http.Response, body []byte) (*http.Response, error) {
+		return NewResponse(http.StatusAccepted, "application/json", body), nil
+	})
+
+	go proxy.Process(context.Background())
+
+	address := "http://" + listener.Addr().String()
+
+	for path, body := range map[string]string{
+		"/v1.37/auth":              `{"username":"ci","password":"hunter2","serveraddress":"registry"}`,
+		"/v1.37/containers/create": `{"Image":"alpine","Env":["DB_PASSWORD=s3cret","DEBUG"]}`,
+	} {
+		resp, err := http.Post(address+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal("Failed to send the request:", err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	// the records are written after the responses are sent
+	deadline := time.Now().Add(time.Second)
+	for strings.Count(output.String(), "\n") < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	records := map[string]*AuditRecord{}
+
+	scanner := bufio.NewScanner(strings.NewReader(output.String()))
+	for scanner.Scan() {
+		var record AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal("Invalid audit record:", scanner.Text(), err)
+		}
+
+		records[record.Operation] = &record
+	}
+
+	auth, ok := records["SystemAuth"]
+	if !ok {
+		t.Fatal("Missing audit record for SystemAuth:", output.String())
+	}
+
+	if auth.Method != "POST" || auth.Path != "/v1.37/auth" || auth.RequestID == "" ||
+		auth.Status != http.StatusAccepted || auth.UpstreamStatus != http.StatusOK {
+		t.Error("Unexpected audit record:", auth)
+	}
+	if len(auth.Decisions) != 2 ||
+		auth.Decisions[0] != (FilterDecision{Kind: "request", Handler: "* /auth", Outcome: "passed"}) ||
+		auth.Decisions[1] != (FilterDecision{Kind: "response", Handler: "POST /auth", Outcome: "modified"}) {
+		t.Error("Unexpected decisions:", auth.Decisions)
+	}
+
+	if strings.Contains(output.String(), "hunter2") || strings.Contains(output.String(), "s3cret") || strings.Contains(output.String(), `"abc"`) {
+		t.Error("Secrets were not redacted:", output.String())
+	}
+	if !strings.Contains(string(auth.RequestBody), `"password":"***"`) ||
+		!strings.Contains(string(auth.RequestBody), `"username":"ci"`) {
+		t.Error("Unexpected request body:", string(auth.RequestBody))
+	}
+	if !strings.Contains(string(auth.ResponseBody), `"IdentityToken":"***"`) {
+		t.Error("Unexpected response body:", string(auth.ResponseBody))
+	}
+
+	create, ok := records["ContainerCreate"]
+	if !ok {
+		t.Fatal("Missing audit record for ContainerCreate:", output.String())
+	}
+
+	if create.Status != http.StatusForbidden || create.UpstreamStatus != 0 || len(create.Decisions) != 1 ||
+		create.Decisions[0] != (FilterDecision{Kind: "request", Handler: "POST /containers/create", Outcome: "denied"}) {
+		t.Error("Unexpected audit record:", create)
+	}
+	if !strings.Contains(string(create.RequestBody), `"Env":["DB_PASSWORD=***","***"]`) {
+		t.Error("Unexpected request body:", string(create.RequestBody))
+	}
+}
+
+func TestOperationNames(t *testing.T) {
+	for _, tc := range []struct {
+		method, path, operation string
+	}{
+		{"GET", "/containers/json", "ContainerList"},
+		{"GET", "/v1.37/containers/abc/json", "ContainerInspect"},
+		{"DELETE", "/containers/abc", "ContainerDelete"},
+		{"POST", "/build", "ImageBuild"},
+		{"GET", "/images/registry:5000/org/app:latest/json", "ImageInspect"},
+		{"DELETE", "/images/org/app", "ImageDelete"},
+		{"GET", "/unknown", "GET /unknown"},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+
+		if operation := OperationOf(req); operation != tc.operation {
+			t.Errorf("Unexpected operation for %s %s: %s", tc.method, tc.path, operation)
+		}
+	}
+}
+
+func TestAuditFileRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+
+	sink, err := NewAuditFileSink(path, 300, 2)
+	if err != nil {
+		t.Fatal("Failed to open the audit file:", err)
+	}
+	defer sink.Close()
+
+	for idx := 0; idx < 10; idx++ {
+		if err := sink.Record(&AuditRecord{Method: "GET", Path: "/info", Operation: "SystemInfo"}); err != nil {
+			t.Fatal("Failed to record:", err)
+		}
+	}
+
+	for _, name := range []string{"audit.log", "audit.log.1", "audit.log.2"} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal("Missing audit file:", err)
+		}
+
+		if info.Size() > 300 {
+			t.Error("Audit file over the maximum size:", name, info.Size())
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "audit.log.3")); !os.IsNotExist(err) {
+		t.Error("Unexpected audit backup:", err)
+	}
+}
@@ -0,0 +1,115 @@
+package connect
+
+import (
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CommandDialer returns a dialer for NewProxy that starts the given command for every connection
+// and speaks HTTP over its stdin and stdout, like `ssh host docker system dial-stdio` does for ssh:// hosts.
+func CommandDialer(name string, args ...string) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		cmd := exec.Command(name, args...)
+		cmd.Stderr = os.Stderr
+
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+
+		return &commandConn{
+			cmd:    cmd,
+			stdin:  stdin,
+			stdout: stdout,
+			addr:   commandAddr(strings.Join(cmd.Args, " ")),
+		}, nil
+	}
+}
+
+func sshDialer(user, host, port string) func() (net.Conn, error) {
+	var args []string
+	if user != "" {
+		args = append(args, "-l", user)
+	}
+	if port != "" {
+		args = append(args, "-p", port)
+	}
+
+	return CommandDialer("ssh", append(args, "--", host, "docker", "system", "dial-stdio")...)
+}
+
+type commandAddr string
+
+func (a commandAddr) Network() string {
+	return "command"
+}
+
+func (a commandAddr) String() string {
+	return string(a)
+}
+
+// commandConn is a connection over the pipes of a running command,
+// which stops when the connection is closed.
+type commandConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	addr   net.Addr
+
+	closeOnce sync.Once
+}
+
+func (c *commandConn) Read(b []byte) (int, error) {
+	return c.stdout.Read(b)
+}
+
+func (c *commandConn) Write(b []byte) (int, error) {
+	return c.stdin.Write(b)
+}
+
+func (c *commandConn) CloseRead() error {
+	return c.stdout.Close()
+}
+
+func (c *commandConn) CloseWrite() error {
+	return c.stdin.Close()
+}
+
+func (c *commandConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.stdin.Close()
+		c.stdout.Close()
+
+		c.cmd.Process.Kill()
+		c.cmd.Wait()
+	})
+
+	return nil
+}
+
+func (c *commandConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *commandConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// pipes do not support deadlines, closing the connection stops any pending reads and writes
+func (c *commandConn) SetDeadline(t time.Time) error      { return nil }
+func (c *commandConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *commandConn) SetWriteDeadline(t time.Time) error { return nil }
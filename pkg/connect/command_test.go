@@ -0,0 +1,72 @@
+package connect
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestCommandDialerHelperProcess relays stdin and stdout to the address in
+// its environment when started by the test, like `docker system dial-stdio`.
+func TestCommandDialerHelperProcess(t *testing.T) {
+	address := os.Getenv("DOCKER_FILTER_TEST_RELAY")
+	if address == "" {
+		return
+	}
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	go func() {
+		io.Copy(conn, os.Stdin)
+		conn.(*net.TCPConn).CloseWrite()
+	}()
+
+	io.Copy(os.Stdout, conn)
+	os.Exit(0)
+}
+
+func TestCommandDialer(t *testing.T) {
+	SetLogLevel(LogLevel_WARN)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(append([]byte("echo:"), body...))
+	}))
+	defer server.Close()
+
+	os.Setenv("DOCKER_FILTER_TEST_RELAY", server.Listener.Addr().String())
+	defer os.Unsetenv("DOCKER_FILTER_TEST_RELAY")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen:", err)
+	}
+	defer listener.Close()
+
+	proxy := NewProxy(CommandDialer(os.Args[0], "-test.run=TestCommandDialerHelperProcess"))
+	proxy.AddListener("", listener)
+
+	go proxy.Process(context.Background())
+
+	for _, payload := range []string{"first", "second"} {
+		resp, err := http.Post("http://"+listener.Addr().String()+"/containers/create", "text/plain", strings.NewReader(payload))
+		if err != nil {
+			t.Fatal("Failed to send the request:", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if string(body) != "echo:"+payload {
+			t.Error("Unexpected response:", resp.Status, string(body))
+		}
+	}
+}
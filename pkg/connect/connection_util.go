@@ -2,26 +2,32 @@ package connect
 
 import "net"
 
-func (cp *connectionPair) closeReading() {
+type readCloser interface {
+	CloseRead() error
+}
+
+type writeCloser interface {
+	CloseWrite() error
+}
+
+func (cp *connectionPair) closeReading(upstream *upstreamConn) {
 	closeRead(cp.localConn.Conn)
-	closeWrite(cp.remoteConn)
+	closeWrite(upstream.Conn)
 }
 
+// closeRead half-closes connections that support it, like TCP, Unix socket and command connections
 func closeRead(c net.Conn) error {
-	if tcpConn, ok := c.(*net.TCPConn); ok {
-		return tcpConn.CloseRead()
-	} else if unixConn, ok := c.(*net.UnixConn); ok {
-		return unixConn.CloseRead()
+	if rc, ok := c.(readCloser); ok {
+		return rc.CloseRead()
 	} else {
 		return nil
 	}
 }
 
+// closeWrite half-closes connections that support it, like TCP, Unix socket, TLS and command connections
 func closeWrite(c net.Conn) error {
-	if tcpConn, ok := c.(*net.TCPConn); ok {
-		return tcpConn.CloseWrite()
-	} else if unixConn, ok := c.(*net.UnixConn); ok {
-		return unixConn.CloseWrite()
+	if wc, ok := c.(writeCloser); ok {
+		return wc.CloseWrite()
 	} else {
 		return nil
 	}
@@ -0,0 +1,134 @@
+// Package connecttest provides utilities to test the filters of a proxy, with a Docker client
+// sending requests through the proxy to an in-process fake daemon.
+//
+//	env := connecttest.New(t)
+//	env.Proxy.On("POST", "/containers/create", myFilter)
+//	env.Start()
+//
+//	env.Client.ContainerCreate(...)
+//
+//	request := env.Daemon.AssertReceived(t, "POST", "/containers/create")
+package connecttest
+
+import (
+	"context"
+	"github.com/docker/docker/client"
+	"github.com/rycus86/docker-filter/pkg/connect"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const shutdownTimeout = 5 * time.Second
+
+// Env is a proxy in front of a fake daemon, with a client connected to the proxy.
+type Env struct {
+	// Daemon is the upstream of the proxy
+	Daemon *Daemon
+	// Proxy forwards the requests to the daemon, register the filters to test on it before Start
+	Proxy *connect.Proxy
+	// Client sends the requests to the proxy
+	Client *client.Client
+
+	listener net.Listener
+	cancel   context.CancelFunc
+	logs     *testLog
+}
+
+// New sets up a fake daemon, a proxy listening on a local TCP port with the listener name "test",
+// and a client for it, which are all closed when the test and its subtests complete.
+// The proxy logs to the test log, and starts accepting requests when Start is called.
+func New(t testing.TB) *Env {
+	t.Helper()
+
+	daemon := NewDaemon()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		daemon.Close()
+		t.Fatal("Failed to listen:", err)
+	}
+
+	logs := &testLog{t: t}
+
+	proxy := connect.NewProxy(daemon.Dial)
+	proxy.AddListener("test", listener)
+	proxy.SetLogger(connect.NewTextLogger(logs, connect.LogLevel_DEBUG))
+
+	cli, err := client.NewClientWithOpts(
+		client.WithHost("tcp://"+listener.Addr().String()),
+		client.WithVersion(APIVersion),
+	)
+	if err != nil {
+		listener.Close()
+		daemon.Close()
+		t.Fatal("Failed to create the client:", err)
+	}
+
+	env := &Env{Daemon: daemon, Proxy: proxy, Client: cli, listener: listener, logs: logs}
+	t.Cleanup(env.close)
+
+	return env
+}
+
+// Start starts accepting requests on the proxy, after the filters are registered on it.
+func (env *Env) Start() {
+	if env.cancel != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	env.cancel = cancel
+
+	go env.Proxy.Process(ctx)
+}
+
+// Address is the address of the proxy, like tcp://127.0.0.1:12345.
+func (env *Env) Address() string {
+	return "tcp://" + env.listener.Addr().String()
+}
+
+func (env *Env) close() {
+	env.Client.Close()
+
+	if env.cancel != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		env.Proxy.Shutdown(ctx)
+		env.cancel()
+	}
+
+	env.listener.Close()
+	env.Daemon.Close()
+	env.logs.close()
+}
+
+// testLog writes the logs of the proxy to the test log, shown for failed tests or with -v,
+// until the test completes.
+type testLog struct {
+	t testing.TB
+
+	lock   sync.Mutex
+	closed bool
+}
+
+func (l *testLog) Write(p []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if !l.closed {
+		l.t.Log(strings.TrimSuffix(string(p), "\n"))
+	}
+
+	return len(p), nil
+}
+
+func (l *testLog) close() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.closed = true
+}
@@ -0,0 +1,201 @@
+package connecttest
+
+import (
+	"bytes"
+	"context"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/rycus86/docker-filter/pkg/connect"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestContainers(t *testing.T) {
+	env := New(t)
+
+	env.Proxy.On("POST", "/containers/create",
+		connect.FilterRequestAsJson(
+			func() connect.T { return &map[string]interface{}{} },
+			func(req connect.T) connect.T {
+				payload := *req.(*map[string]interface{})
+				payload["Labels"] = map[string]string{"filtered": "1"}
+				return payload
+			}))
+	env.Start()
+
+	ctx := context.Background()
+
+	if _, err := env.Client.Ping(ctx); err != nil {
+		t.Fatal("Failed to ping the daemon:", err)
+	}
+
+	created, err := env.Client.ContainerCreate(ctx,
+		&container.Config{Image: "alpine", Cmd: []string{"sleep", "10"}},
+		&container.HostConfig{}, &network.NetworkingConfig{}, "sleeper")
+	if err != nil {
+		t.Fatal("Failed to create the container:", err)
+	}
+
+	if err := env.Client.ContainerStart(ctx, "sleeper", types.ContainerStartOptions{}); err != nil {
+		t.Fatal("Failed to start the container:", err)
+	}
+
+	containers, err := env.Client.ContainerList(ctx, types.ContainerListOptions{})
+	if err != nil {
+		t.Fatal("Failed to list the containers:", err)
+	}
+	if len(containers) != 1 || containers[0].ID != created.ID || containers[0].Labels["filtered"] != "1" ||
+		containers[0].Command != "sleep 10" || containers[0].State != "running" {
+		t.Errorf("Unexpected containers: %+v", containers)
+	}
+
+	inspected, err := env.Client.ContainerInspect(ctx, created.ID[:12])
+	if err != nil {
+		t.Fatal("Failed to inspect the container:", err)
+	}
+	if inspected.Name != "/sleeper" || !inspected.State.Running {
+		t.Errorf("Unexpected container: %+v", inspected.ContainerJSONBase)
+	}
+
+	if _, err := env.Client.ContainerInspect(ctx, "missing"); !client.IsErrNotFound(err) {
+		t.Error("Unexpected error for a missing container:", err)
+	}
+
+	var body container.Config
+	if err := env.Daemon.AssertReceived(t, "POST", "/containers/create").DecodeJSON(&body); err != nil {
+		t.Fatal("Failed to decode the request body:", err)
+	}
+	if body.Labels["filtered"] != "1" {
+		t.Error("The daemon did not receive the filtered request:", body.Labels)
+	}
+
+	if c, ok := env.Daemon.Container("sleeper"); !ok || c.Config.Image != "alpine" {
+		t.Error("Unexpected container on the daemon:", c)
+	}
+
+	env.Daemon.AssertNotReceived(t, "POST", "/containers/{id}/exec")
+	env.Daemon.AssertRequestCount(t, 6)
+}
+
+func TestExec(t *testing.T) {
+	env := New(t)
+
+	env.Proxy.OnFrames("POST", "/exec/{id}/start", func(req *http.Request, frame *connect.Frame) (*connect.Frame, error) {
+		if frame.Stream == connect.Stdout {
+			return &connect.Frame{Stream: connect.Stdout, Data: bytes.Replace(frame.Data, []byte("secret"), []byte("***"), -1)}, nil
+		}
+		return nil, nil
+	})
+	env.Start()
+
+	env.Daemon.OnExec(func(containerID string, cmd []string) (string, string, int) {
+		return "token=secret\n", strings.Join(cmd, " ") + "\n", 3
+	})
+
+	ctx := context.Background()
+
+	created, err := env.Client.ContainerCreate(ctx, &container.Config{Image: "alpine"}, nil, nil, "")
+	if err != nil {
+		t.Fatal("Failed to create the container:", err)
+	}
+	env.Client.ContainerStart(ctx, created.ID, types.ContainerStartOptions{})
+
+	exec, err := env.Client.ContainerExecCreate(ctx, created.ID, types.ExecConfig{
+		Cmd: []string{"cat", "/secrets"}, AttachStdout: true, AttachStderr: true,
+	})
+	if err != nil {
+		t.Fatal("Failed to create the exec session:", err)
+	}
+
+	attached, err := env.Client.ContainerExecAttach(ctx, exec.ID, types.ExecStartCheck{})
+	if err != nil {
+		t.Fatal("Failed to attach to the exec session:", err)
+	}
+	defer attached.Close()
+
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	if _, err := stdcopy.StdCopy(stdout, stderr, attached.Reader); err != nil {
+		t.Error("Failed to read the exec output:", err)
+	}
+
+	if stdout.String() != "token=***\n" || stderr.String() != "cat /secrets\n" {
+		t.Errorf("Unexpected exec output: %q %q", stdout.String(), stderr.String())
+	}
+
+	if inspected, err := env.Client.ContainerExecInspect(ctx, exec.ID); err != nil || inspected.ExitCode != 3 {
+		t.Error("Unexpected exec result:", inspected, err)
+	}
+}
+
+func TestServices(t *testing.T) {
+	env := New(t)
+
+	env.Proxy.On("POST", "/services/{id}/update", func(req *http.Request, body []byte) (*http.Request, error) {
+		return nil, connect.NewDenial(http.StatusForbidden, "services are read-only")
+	})
+	env.Start()
+
+	ctx := context.Background()
+
+	created, err := env.Client.ServiceCreate(ctx, swarm.ServiceSpec{
+		Annotations:  swarm.Annotations{Name: "web"},
+		TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{Image: "nginx"}},
+	}, types.ServiceCreateOptions{})
+	if err != nil {
+		t.Fatal("Failed to create the service:", err)
+	}
+
+	service, _, err := env.Client.ServiceInspectWithRaw(ctx, "web", types.ServiceInspectOptions{})
+	if err != nil {
+		t.Fatal("Failed to inspect the service:", err)
+	}
+	if service.ID != created.ID || service.Spec.TaskTemplate.ContainerSpec.Image != "nginx:latest" {
+		t.Errorf("Unexpected service: %+v", service)
+	}
+
+	service.Spec.TaskTemplate.ContainerSpec.Image = "httpd"
+	if _, err := env.Client.ServiceUpdate(ctx, service.ID, service.Version, service.Spec, types.ServiceUpdateOptions{}); err == nil ||
+		!strings.Contains(err.Error(), "services are read-only") {
+		t.Error("Unexpected update result:", err)
+	}
+
+	env.Daemon.AssertNotReceived(t, "POST", "/services/{id}/update")
+
+	if services, err := env.Client.ServiceList(ctx, types.ServiceListOptions{}); err != nil || len(services) != 1 {
+		t.Error("Unexpected services:", services, err)
+	}
+}
+
+func TestScriptedResponses(t *testing.T) {
+	env := New(t)
+	env.Start()
+
+	env.Daemon.Handle("GET", "/version", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"message":"scripted failure"}`))
+	})
+
+	if _, err := env.Client.ServerVersion(context.Background()); err == nil || !strings.Contains(err.Error(), "scripted failure") {
+		t.Error("Unexpected version result:", err)
+	}
+
+	if request := env.Daemon.AssertReceived(t, "*", "/version"); request.Path != "/v"+APIVersion+"/version" {
+		t.Error("Unexpected request path:", request.Path)
+	}
+
+	// the templates accept the same expressions as the ones of the proxy
+	env.Daemon.Handle("GET", "/images/{name:.+}/json", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Id":"sha256:1234"}`))
+	})
+
+	if image, _, err := env.Client.ImageInspectWithRaw(context.Background(), "library/alpine:3.8"); err != nil || image.ID != "sha256:1234" {
+		t.Error("Unexpected image:", image, err)
+	}
+
+	env.Daemon.AssertReceived(t, "GET", "/images/{name:.+}/json")
+}
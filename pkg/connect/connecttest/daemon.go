@@ -0,0 +1,752 @@
+package connecttest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/rycus86/docker-filter/pkg/connect"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	// APIVersion is the Engine API version the fake daemon reports
+	APIVersion = "1.37"
+	// Version is the Docker version the fake daemon reports
+	Version = "18.03.1-ce"
+)
+
+// Request is a request the fake daemon received, after the proxy filtered it.
+type Request struct {
+	Method string
+	Path   string
+	Query  string
+	Header http.Header
+	Body   []byte
+}
+
+// DecodeJSON decodes the JSON body of the request into v.
+func (r *Request) DecodeJSON(v interface{}) error {
+	return json.Unmarshal(r.Body, v)
+}
+
+// ExecFunc produces the output and exit code of a command executed in a container of the fake daemon.
+type ExecFunc func(containerID string, cmd []string) (stdout, stderr string, exitCode int)
+
+// Daemon is an in-process fake Docker daemon, implementing a small part of the Engine API:
+// ping, version and info, creating, listing, inspecting, starting and removing containers,
+// running exec sessions, and creating, listing, inspecting, updating and removing services.
+// Other endpoints, or these ones with different behavior, can be scripted with Handle.
+type Daemon struct {
+	server *httptest.Server
+	routes []*daemonRoute
+
+	lock       sync.Mutex
+	scripted   []*daemonRoute
+	requests   []*Request
+	sequence   int
+	containers []*types.ContainerJSON
+	execs      map[string]*types.ContainerExecInspect
+	execConfig map[string]*types.ExecConfig
+	services   []*swarm.Service
+	onExec     ExecFunc
+}
+
+type daemonRoute struct {
+	method  string
+	pattern *regexp.Regexp
+	handler func(w http.ResponseWriter, r *http.Request, params map[string]string)
+}
+
+// NewDaemon starts a fake daemon on a local TCP port, close it with Close.
+func NewDaemon() *Daemon {
+	d := &Daemon{
+		execs:      map[string]*types.ContainerExecInspect{},
+		execConfig: map[string]*types.ExecConfig{},
+		onExec: func(containerID string, cmd []string) (string, string, int) {
+			return "", "", 0
+		},
+	}
+
+	d.routes = []*daemonRoute{
+		newRoute("GET", "/_ping", d.ping),
+		newRoute("HEAD", "/_ping", d.ping),
+		newRoute("GET", "/version", d.version),
+		newRoute("GET", "/info", d.info),
+
+		newRoute("POST", "/containers/create", d.containerCreate),
+		newRoute("GET", "/containers/json", d.containerList),
+		newRoute("GET", "/containers/{id}/json", d.containerInspect),
+		newRoute("POST", "/containers/{id}/start", d.containerStart),
+		newRoute("DELETE", "/containers/{id}", d.containerDelete),
+		newRoute("POST", "/containers/{id}/exec", d.execCreate),
+		newRoute("POST", "/exec/{id}/start", d.execStart),
+		newRoute("GET", "/exec/{id}/json", d.execInspect),
+
+		newRoute("POST", "/services/create", d.serviceCreate),
+		newRoute("GET", "/services", d.serviceList),
+		newRoute("GET", "/services/{id}", d.serviceInspect),
+		newRoute("POST", "/services/{id}/update", d.serviceUpdate),
+		newRoute("DELETE", "/services/{id}", d.serviceDelete),
+	}
+
+	d.server = httptest.NewServer(http.HandlerFunc(d.serveHTTP))
+
+	return d
+}
+
+// Close stops the fake daemon.
+func (d *Daemon) Close() {
+	d.server.Close()
+}
+
+// Addr is the address the fake daemon listens on.
+func (d *Daemon) Addr() net.Addr {
+	return d.server.Listener.Addr()
+}
+
+// Dial connects to the fake daemon, it can be used as the dialer of a proxy.
+func (d *Daemon) Dial() (net.Conn, error) {
+	return net.Dial("tcp", d.Addr().String())
+}
+
+// Handle scripts the response of the fake daemon for the HTTP method (or * for any) and path template,
+// like /containers/{id}/logs or /images/{name:.+}/json, matched like the ones of connect.Proxy.On,
+// where the optional API version prefix is ignored. Scripted handlers take
+// precedence over the built-in endpoints, and the ones registered later over the earlier ones.
+func (d *Daemon) Handle(method, pathTemplate string, handler http.HandlerFunc) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.scripted = append([]*daemonRoute{newRoute(method, pathTemplate,
+		func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+			handler(w, r)
+		})}, d.scripted...)
+}
+
+// OnExec sets the function that produces the output of the exec sessions, which have no output by default.
+func (d *Daemon) OnExec(execFunc ExecFunc) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.onExec = execFunc
+}
+
+// Requests returns the requests the fake daemon received, in order.
+func (d *Daemon) Requests() []*Request {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return append([]*Request(nil), d.requests...)
+}
+
+// Received returns the requests the fake daemon received for the method (or * for any) and path template.
+func (d *Daemon) Received(method, pathTemplate string) []*Request {
+	route := newRoute(method, pathTemplate, nil)
+
+	var matching []*Request
+	for _, request := range d.Requests() {
+		if _, ok := route.match(request.Method, request.Path); ok {
+			matching = append(matching, request)
+		}
+	}
+
+	return matching
+}
+
+// AssertReceived fails the test if the fake daemon did not receive a request for the method and
+// path template, and returns the last one it did.
+func (d *Daemon) AssertReceived(t testing.TB, method, pathTemplate string) *Request {
+	t.Helper()
+
+	matching := d.Received(method, pathTemplate)
+	if len(matching) == 0 {
+		t.Fatalf("The daemon did not receive %s %s, only: %s", method, pathTemplate, d.describeRequests())
+		return nil
+	}
+
+	return matching[len(matching)-1]
+}
+
+// AssertNotReceived fails the test if the fake daemon received a request for the method and path template.
+func (d *Daemon) AssertNotReceived(t testing.TB, method, pathTemplate string) {
+	t.Helper()
+
+	if matching := d.Received(method, pathTemplate); len(matching) > 0 {
+		t.Errorf("The daemon received %d unexpected %s %s requests", len(matching), method, pathTemplate)
+	}
+}
+
+// AssertRequestCount fails the test if the fake daemon did not receive exactly the given number of requests.
+func (d *Daemon) AssertRequestCount(t testing.TB, expected int) {
+	t.Helper()
+
+	if count := len(d.Requests()); count != expected {
+		t.Errorf("The daemon received %d requests instead of %d: %s", count, expected, d.describeRequests())
+	}
+}
+
+// Container returns a copy of a container of the fake daemon by its ID, ID prefix or name.
+func (d *Daemon) Container(idOrName string) (*types.ContainerJSON, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	c, ok := d.findContainer(idOrName)
+	if !ok {
+		return nil, false
+	}
+
+	var copied types.ContainerJSON
+	deepCopy(c, &copied)
+
+	return &copied, true
+}
+
+// Service returns a copy of a service of the fake daemon by its ID, ID prefix or name.
+func (d *Daemon) Service(idOrName string) (*swarm.Service, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	_, service := d.findService(idOrName)
+	if service == nil {
+		return nil, false
+	}
+
+	var copied swarm.Service
+	deepCopy(service, &copied)
+
+	return &copied, true
+}
+
+func deepCopy(from, to interface{}) {
+	encoded, _ := json.Marshal(from)
+	json.Unmarshal(encoded, to)
+}
+
+func (d *Daemon) describeRequests() string {
+	var described []string
+	for _, request := range d.Requests() {
+		described = append(described, request.Method+" "+request.Path)
+	}
+
+	return "[" + strings.Join(described, ", ") + "]"
+}
+
+func (d *Daemon) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	d.lock.Lock()
+	d.requests = append(d.requests, &Request{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Query:  r.URL.RawQuery,
+		Header: r.Header,
+		Body:   body,
+	})
+	routes := append(append([]*daemonRoute(nil), d.scripted...), d.routes...)
+	d.lock.Unlock()
+
+	for _, route := range routes {
+		if params, ok := route.match(r.Method, r.URL.Path); ok {
+			route.handler(w, r, params)
+			return
+		}
+	}
+
+	writeError(w, http.StatusNotFound, "page not found")
+}
+
+// newRoute matches the paths the same way as the handlers of the proxy registered with On.
+func newRoute(method, pathTemplate string, handler func(http.ResponseWriter, *http.Request, map[string]string)) *daemonRoute {
+	return &daemonRoute{
+		method:  method,
+		pattern: connect.CompilePathTemplate(pathTemplate),
+		handler: handler,
+	}
+}
+
+func (route *daemonRoute) match(method, path string) (map[string]string, bool) {
+	if route.method != "*" && !strings.EqualFold(route.method, method) {
+		return nil, false
+	}
+
+	m := route.pattern.FindStringSubmatch(path)
+	if m == nil {
+		return nil, false
+	}
+
+	params := map[string]string{}
+	for idx, name := range route.pattern.SubexpNames() {
+		if name != "" {
+			params[name] = m[idx]
+		}
+	}
+
+	return params, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"message": message})
+}
+
+// nextID returns a new 64 character hexadecimal ID, like the ones of the real daemon.
+func (d *Daemon) nextID() string {
+	d.sequence++
+
+	var seed [8]byte
+	binary.BigEndian.PutUint64(seed[:], uint64(d.sequence))
+
+	sum := sha256.Sum256(seed[:])
+	return hex.EncodeToString(sum[:])
+}
+
+func (d *Daemon) ping(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	w.Header().Set("API-Version", APIVersion)
+	w.Header().Set("Docker-Experimental", "false")
+	w.Header().Set("OSType", "linux")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	if r.Method != "HEAD" {
+		w.Write([]byte("OK"))
+	}
+}
+
+func (d *Daemon) version(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	writeJSON(w, http.StatusOK, types.Version{
+		Version:       Version,
+		APIVersion:    APIVersion,
+		MinAPIVersion: "1.12",
+		Os:            "linux",
+		Arch:          "amd64",
+		KernelVersion: "4.9.0-fake",
+	})
+}
+
+func (d *Daemon) info(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	running := 0
+	for _, c := range d.containers {
+		if c.State.Running {
+			running++
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"ID":                "FAKE:DAEMON",
+		"Name":              "connecttest",
+		"Containers":        len(d.containers),
+		"ContainersRunning": running,
+		"ContainersStopped": len(d.containers) - running,
+		"ServerVersion":     Version,
+		"OSType":            "linux",
+		"Architecture":      "x86_64",
+	})
+}
+
+func (d *Daemon) containerCreate(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	var body struct {
+		*container.Config
+		HostConfig       *container.HostConfig
+		NetworkingConfig *network.NetworkingConfig
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Config == nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprint("invalid container config: ", err))
+		return
+	}
+	if body.Image == "" {
+		writeError(w, http.StatusBadRequest, "no image specified")
+		return
+	}
+	if body.HostConfig == nil {
+		body.HostConfig = &container.HostConfig{}
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	name := r.URL.Query().Get("name")
+	if name != "" {
+		if _, exists := d.findContainer(name); exists {
+			writeError(w, http.StatusConflict, "Conflict. The container name \"/"+name+"\" is already in use")
+			return
+		}
+	}
+
+	id := d.nextID()
+	if name == "" {
+		name = "container_" + strconv.Itoa(d.sequence)
+	}
+
+	var path string
+	var args []string
+	if cmd := append(append([]string(nil), body.Entrypoint...), body.Cmd...); len(cmd) > 0 {
+		path, args = cmd[0], cmd[1:]
+	}
+
+	d.containers = append(d.containers, &types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:         id,
+			Created:    time.Now().UTC().Format(time.RFC3339Nano),
+			Path:       path,
+			Args:       args,
+			State:      &types.ContainerState{Status: "created"},
+			Image:      body.Image,
+			Name:       "/" + name,
+			Driver:     "overlay2",
+			Platform:   "linux",
+			HostConfig: body.HostConfig,
+		},
+		Config:          body.Config,
+		NetworkSettings: &types.NetworkSettings{},
+	})
+
+	writeJSON(w, http.StatusCreated, container.ContainerCreateCreatedBody{ID: id, Warnings: []string{}})
+}
+
+func (d *Daemon) containerList(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	all, _ := strconv.ParseBool(r.URL.Query().Get("all"))
+
+	list := []types.Container{}
+	for idx := len(d.containers) - 1; idx >= 0; idx-- {
+		c := d.containers[idx]
+		if !all && !c.State.Running {
+			continue
+		}
+
+		created, _ := time.Parse(time.RFC3339Nano, c.Created)
+
+		list = append(list, types.Container{
+			ID:      c.ID,
+			Names:   []string{c.Name},
+			Image:   c.Image,
+			Command: strings.TrimSpace(c.Path + " " + strings.Join(c.Args, " ")),
+			Created: created.Unix(),
+			Labels:  c.Config.Labels,
+			State:   c.State.Status,
+			Status:  c.State.Status,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (d *Daemon) containerInspect(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	c, ok := d.findContainer(params["id"])
+	if !ok {
+		writeError(w, http.StatusNotFound, "No such container: "+params["id"])
+		return
+	}
+
+	writeJSON(w, http.StatusOK, c)
+}
+
+func (d *Daemon) containerStart(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	c, ok := d.findContainer(params["id"])
+	if !ok {
+		writeError(w, http.StatusNotFound, "No such container: "+params["id"])
+		return
+	}
+
+	if c.State.Running {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	c.State.Status, c.State.Running, c.State.Pid = "running", true, 1000+d.sequence
+	c.State.StartedAt = time.Now().UTC().Format(time.RFC3339Nano)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *Daemon) containerDelete(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	c, ok := d.findContainer(params["id"])
+	if !ok {
+		writeError(w, http.StatusNotFound, "No such container: "+params["id"])
+		return
+	}
+
+	if force, _ := strconv.ParseBool(r.URL.Query().Get("force")); c.State.Running && !force {
+		writeError(w, http.StatusConflict, "You cannot remove a running container "+c.ID+". Stop the container before attempting removal or force remove")
+		return
+	}
+
+	for idx, existing := range d.containers {
+		if existing == c {
+			d.containers = append(d.containers[:idx], d.containers[idx+1:]...)
+			break
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *Daemon) findContainer(idOrName string) (*types.ContainerJSON, bool) {
+	for _, c := range d.containers {
+		if c.Name == "/"+idOrName || c.Name == idOrName {
+			return c, true
+		}
+	}
+
+	for _, c := range d.containers {
+		if idOrName != "" && strings.HasPrefix(c.ID, idOrName) {
+			return c, true
+		}
+	}
+
+	return nil, false
+}
+
+func (d *Daemon) execCreate(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	var config types.ExecConfig
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprint("invalid exec config: ", err))
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	c, ok := d.findContainer(params["id"])
+	if !ok {
+		writeError(w, http.StatusNotFound, "No such container: "+params["id"])
+		return
+	}
+	if !c.State.Running {
+		writeError(w, http.StatusConflict, "Container "+c.ID+" is not running")
+		return
+	}
+
+	id := d.nextID()
+	d.execs[id] = &types.ContainerExecInspect{ExecID: id, ContainerID: c.ID}
+	d.execConfig[id] = &config
+	c.ExecIDs = append(c.ExecIDs, id)
+
+	writeJSON(w, http.StatusCreated, types.IDResponse{ID: id})
+}
+
+func (d *Daemon) execStart(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	var check types.ExecStartCheck
+	json.NewDecoder(r.Body).Decode(&check)
+
+	d.lock.Lock()
+	exec, ok := d.execs[params["id"]]
+	config := d.execConfig[params["id"]]
+	onExec := d.onExec
+	d.lock.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusNotFound, "No such exec instance: "+params["id"])
+		return
+	}
+
+	stdout, stderr, exitCode := onExec(exec.ContainerID, config.Cmd)
+
+	d.lock.Lock()
+	exec.ExitCode = exitCode
+	d.lock.Unlock()
+
+	if check.Detach {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	conn, buffered, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	if check.Tty {
+		buffered.WriteString("HTTP/1.1 101 UPGRADED\r\n" +
+			"Content-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+		buffered.WriteString(stdout + stderr)
+	} else {
+		buffered.WriteString("HTTP/1.1 101 UPGRADED\r\n" +
+			"Content-Type: application/vnd.docker.multiplexed-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+		writeFrame(buffered, 1, stdout)
+		writeFrame(buffered, 2, stderr)
+	}
+
+	buffered.Flush()
+}
+
+// writeFrame writes the data in the multiplexed stream format, with the stream and size in front.
+func writeFrame(w io.Writer, stream byte, data string) {
+	if data == "" {
+		return
+	}
+
+	header := []byte{stream, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(header[4:], uint32(len(data)))
+
+	w.Write(append(header, data...))
+}
+
+func (d *Daemon) execInspect(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	exec, ok := d.execs[params["id"]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "No such exec instance: "+params["id"])
+		return
+	}
+
+	writeJSON(w, http.StatusOK, exec)
+}
+
+func (d *Daemon) serviceCreate(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	var spec swarm.ServiceSpec
+	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprint("invalid service spec: ", err))
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if _, existing := d.findService(spec.Name); existing != nil && spec.Name != "" {
+		writeError(w, http.StatusConflict, "rpc error: code = AlreadyExists desc = name conflicts with an existing object")
+		return
+	}
+
+	now := time.Now().UTC()
+
+	service := &swarm.Service{ID: d.nextID()[:25], Spec: spec}
+	service.Version.Index = uint64(d.sequence)
+	service.CreatedAt, service.UpdatedAt = now, now
+
+	if service.Spec.Name == "" {
+		service.Spec.Name = "service_" + strconv.Itoa(d.sequence)
+	}
+
+	d.services = append(d.services, service)
+
+	writeJSON(w, http.StatusCreated, types.ServiceCreateResponse{ID: service.ID})
+}
+
+func (d *Daemon) serviceList(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	list := []swarm.Service{}
+	for _, service := range d.services {
+		list = append(list, *service)
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (d *Daemon) serviceInspect(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	_, service := d.findService(params["id"])
+	if service == nil {
+		writeError(w, http.StatusNotFound, "service "+params["id"]+" not found")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, service)
+}
+
+func (d *Daemon) serviceUpdate(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	var spec swarm.ServiceSpec
+	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprint("invalid service spec: ", err))
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	_, service := d.findService(params["id"])
+	if service == nil {
+		writeError(w, http.StatusNotFound, "service "+params["id"]+" not found")
+		return
+	}
+
+	if version := r.URL.Query().Get("version"); version != strconv.FormatUint(service.Version.Index, 10) {
+		writeError(w, http.StatusBadRequest, "rpc error: code = Unknown desc = update out of sequence")
+		return
+	}
+
+	previous := service.Spec
+	d.sequence++
+
+	service.PreviousSpec = &previous
+	service.Spec = spec
+	service.Version.Index = uint64(d.sequence)
+	service.UpdatedAt = time.Now().UTC()
+
+	writeJSON(w, http.StatusOK, types.ServiceUpdateResponse{})
+}
+
+func (d *Daemon) serviceDelete(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	idx, service := d.findService(params["id"])
+	if service == nil {
+		writeError(w, http.StatusNotFound, "service "+params["id"]+" not found")
+		return
+	}
+
+	d.services = append(d.services[:idx], d.services[idx+1:]...)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (d *Daemon) findService(idOrName string) (int, *swarm.Service) {
+	for idx, service := range d.services {
+		if service.Spec.Name == idOrName || service.ID == idOrName {
+			return idx, service
+		}
+	}
+
+	for idx, service := range d.services {
+		if idOrName != "" && strings.HasPrefix(service.ID, idOrName) {
+			return idx, service
+		}
+	}
+
+	return -1, nil
+}
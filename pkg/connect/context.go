@@ -0,0 +1,73 @@
+package connect
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+type requestContextKey struct{}
+
+// RequestContext holds the details of an exchange that filters can use, and values they
+// can share with each other, from the request filters to the response filters of the same exchange.
+type RequestContext struct {
+	Listener     string
+	ConnectionID int
+	RemoteAddr   string
+	Client       *ClientIdentity
+	RequestID    string
+
+	// Name of the route the request was sent to, empty for the default upstream
+	Upstream string
+
+	lock   sync.Mutex
+	values map[string]interface{}
+}
+
+// ContextOf returns the context of the exchange the request (or the response's request) belongs to.
+// Requests not processed by the proxy get an empty, detached context.
+func ContextOf(req *http.Request) *RequestContext {
+	if req != nil {
+		if rc, ok := req.Context().Value(requestContextKey{}).(*RequestContext); ok {
+			return rc
+		}
+	}
+
+	return &RequestContext{Client: &ClientIdentity{}}
+}
+
+func (rc *RequestContext) Set(key string, value interface{}) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+
+	if rc.values == nil {
+		rc.values = map[string]interface{}{}
+	}
+
+	rc.values[key] = value
+}
+
+func (rc *RequestContext) Get(key string) (interface{}, bool) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+
+	value, ok := rc.values[key]
+	return value, ok
+}
+
+func (cp *connectionPair) newRequestContext() *RequestContext {
+	cp.requestCount++
+
+	return &RequestContext{
+		Listener:     cp.localConn.logPrefix,
+		ConnectionID: cp.connectionId,
+		RemoteAddr:   cp.localConn.RemoteAddr().String(),
+		Client:       cp.localConn.client,
+		RequestID:    fmt.Sprintf("%02d-%04d-%04d", cp.proxy.idx, cp.connectionId, cp.requestCount),
+	}
+}
+
+func withRequestContext(req *http.Request, rc *RequestContext) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), requestContextKey{}, rc))
+}
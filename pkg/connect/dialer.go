@@ -0,0 +1,118 @@
+package connect
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+const (
+	defaultDockerSocket = "/var/run/docker.sock"
+	defaultTCPPort      = "2375"
+	defaultTLSPort      = "2376"
+)
+
+// DefaultDockerHost returns the address of the local daemon, which is the Unix socket
+// under $XDG_RUNTIME_DIR for rootless Docker if it exists, or /var/run/docker.sock.
+func DefaultDockerHost() string {
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" && os.Geteuid() != 0 {
+		rootless := filepath.Join(runtimeDir, "docker.sock")
+		if _, err := os.Stat(rootless); err == nil {
+			return "unix://" + rootless
+		}
+	}
+
+	return "unix://" + defaultDockerSocket
+}
+
+// Dialer returns a dialer for NewProxy that connects to a daemon at a DOCKER_HOST-style
+// address, like unix:///var/run/docker.sock, tcp://host:2376 or ssh://user@host, using TLS if options are given.
+func Dialer(host string, tlsOptions *TLSOptions) (func() (net.Conn, error), error) {
+	address, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+
+	switch address.Scheme {
+	case "unix":
+		path := address.Path
+		if path == "" {
+			path = address.Opaque
+		}
+
+		return func() (net.Conn, error) {
+			return net.Dial("unix", path)
+		}, nil
+
+	case "tcp":
+		hostPort := address.Host
+		if _, _, err := net.SplitHostPort(hostPort); err != nil {
+			// JoinHostPort adds the brackets of IPv6 hosts back
+			if tlsOptions != nil {
+				hostPort = net.JoinHostPort(address.Hostname(), defaultTLSPort)
+			} else {
+				hostPort = net.JoinHostPort(address.Hostname(), defaultTCPPort)
+			}
+		}
+
+		if tlsOptions != nil {
+			return TLSDialer(hostPort, *tlsOptions)
+		}
+
+		return func() (net.Conn, error) {
+			return net.Dial("tcp", hostPort)
+		}, nil
+
+	case "ssh":
+		return sshDialer(address.User.Username(), address.Hostname(), address.Port()), nil
+
+	case "fd":
+		// socket activated file descriptors are listening sockets, there is nothing to dial
+		return nil, errors.New("fd:// addresses can only be listened on, not dialed: " + host)
+
+	default:
+		return nil, errors.New("unsupported daemon address: " + host)
+	}
+}
+
+// DialerFromEnv returns a dialer for NewProxy configured the same way as the Docker client
+// would be, from DOCKER_HOST, DOCKER_TLS_VERIFY, DOCKER_TLS and DOCKER_CERT_PATH.
+func DialerFromEnv() (func() (net.Conn, error), error) {
+	host := os.Getenv("DOCKER_HOST")
+	if host == "" {
+		host = DefaultDockerHost()
+	}
+
+	return Dialer(host, TLSOptionsFromEnv())
+}
+
+// TLSOptionsFromEnv returns the TLS options for connecting to the daemon set in the environment,
+// or nil if neither DOCKER_TLS_VERIFY nor DOCKER_TLS is set.
+func TLSOptionsFromEnv() *TLSOptions {
+	verify := os.Getenv("DOCKER_TLS_VERIFY") != ""
+	if !verify && os.Getenv("DOCKER_TLS") == "" {
+		return nil
+	}
+
+	certPath := os.Getenv("DOCKER_CERT_PATH")
+	if certPath == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			certPath = filepath.Join(home, ".docker")
+		}
+	}
+
+	options := CertPathOptions(certPath)
+	options.Verify = verify
+
+	// the client certificate is optional unless the daemon requires it
+	if _, err := os.Stat(options.CertFile); err != nil {
+		options.CertFile, options.KeyFile = "", ""
+	}
+	if !verify {
+		options.CAFile = ""
+	}
+
+	return &options
+}
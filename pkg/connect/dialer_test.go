@@ -0,0 +1,106 @@
+package connect
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDialerFromDockerHost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-filter-dialer")
+	if err != nil {
+		t.Fatal("Failed to create a temporary directory:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	unixListener, err := net.Listen("unix", filepath.Join(dir, "docker.sock"))
+	if err != nil {
+		t.Fatal("Failed to listen:", err)
+	}
+	defer unixListener.Close()
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen:", err)
+	}
+	defer tcpListener.Close()
+
+	for _, host := range []string{
+		"unix://" + filepath.Join(dir, "docker.sock"),
+		"tcp://" + tcpListener.Addr().String(),
+	} {
+		dialer, err := Dialer(host, nil)
+		if err != nil {
+			t.Fatal("Failed to create a dialer for", host, ":", err)
+		}
+
+		if conn, err := dialer(); err != nil {
+			t.Error("Failed to connect to", host, ":", err)
+		} else {
+			conn.Close()
+		}
+	}
+
+	for _, host := range []string{"fd://", "npipe:////./pipe/docker_engine", "/var/run/docker.sock"} {
+		if _, err := Dialer(host, nil); err == nil {
+			t.Error("Expected an error for", host)
+		}
+	}
+
+	os.Setenv("DOCKER_HOST", "unix://"+filepath.Join(dir, "docker.sock"))
+	defer os.Unsetenv("DOCKER_HOST")
+
+	if dialer, err := DialerFromEnv(); err != nil {
+		t.Error("Failed to create a dialer from the environment:", err)
+	} else if conn, err := dialer(); err != nil {
+		t.Error("Failed to connect using the environment:", err)
+	} else {
+		conn.Close()
+	}
+}
+
+func TestDialerDefaultPortForIPv6(t *testing.T) {
+	listener, err := net.Listen("tcp", "[::1]:"+defaultTCPPort)
+	if err != nil {
+		t.Skip("Failed to listen on the default port of IPv6 localhost:", err)
+	}
+	defer listener.Close()
+
+	dialer, err := Dialer("tcp://[::1]", nil)
+	if err != nil {
+		t.Fatal("Failed to create a dialer:", err)
+	}
+
+	if conn, err := dialer(); err != nil {
+		t.Error("Failed to connect:", err)
+	} else {
+		conn.Close()
+	}
+}
+
+func TestDefaultDockerHostForRootless(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("Rootless sockets are not used for root")
+	}
+
+	dir, err := ioutil.TempDir("", "docker-filter-runtime")
+	if err != nil {
+		t.Fatal("Failed to create a temporary directory:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer os.Setenv("XDG_RUNTIME_DIR", os.Getenv("XDG_RUNTIME_DIR"))
+	os.Setenv("XDG_RUNTIME_DIR", dir)
+
+	if host := DefaultDockerHost(); host != "unix:///var/run/docker.sock" {
+		t.Error("Unexpected default without a rootless socket:", host)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "docker.sock"), nil, 0600)
+
+	if host := DefaultDockerHost(); host != "unix://"+filepath.Join(dir, "docker.sock") {
+		t.Error("Unexpected default with a rootless socket:", host)
+	}
+}
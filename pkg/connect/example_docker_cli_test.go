@@ -2,6 +2,7 @@ package connect
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/network"
@@ -365,7 +366,7 @@ func onDockerCliSetup() error {
 	})
 	proxy.AddListener("test", listener)
 
-	go proxy.Process()
+	go proxy.Process(context.Background())
 
 	cliProxy = proxy
 
@@ -264,7 +264,7 @@ func onDockerIntegrationSetup() error {
 	})
 	proxy.AddListener("test", listener)
 
-	go proxy.Process()
+	go proxy.Process(context.Background())
 
 	integrationProxy = proxy
 
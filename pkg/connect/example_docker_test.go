@@ -1,70 +1,60 @@
-package connect
+package connect_test
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/api/types/swarm"
-	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/docker/go-units"
+	"github.com/rycus86/docker-filter/pkg/connect"
+	"github.com/rycus86/docker-filter/pkg/connect/connecttest"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
-	"net/http/httptest"
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 )
 
 var dockerTestCases = map[string]func(*testing.T){
-	"ContainerCreate": testDockerContainerCreate,
-	"ServiceCreate":   testDockerServiceCreate,
-	"ServiceUpdate":   testDockerServiceUpdate,
+	"ContainerCreate":             testDockerContainerCreate,
+	"ContainerCreateLargePayload": testDockerContainerCreateLargePayload,
+	"ChunkedRequest":              testDockerChunkedRequest,
+	"UpgradeNotAccepted":          testDockerUpgradeNotAccepted,
+	"PipelinedRequests":           testDockerPipelinedRequests,
+	"ServiceCreate":               testDockerServiceCreate,
+	"ServiceUpdate":               testDockerServiceUpdate,
+	"PathTemplates":               testDockerPathTemplates,
+	"DirectResponses":             testDockerDirectResponses,
+	"Denials":                     testDockerDenials,
+	"StreamingEvents":             testDockerStreamingEvents,
+	"ExecAndLogsFrames":           testDockerExecAndLogsFrames,
+	"RequestContext":              testDockerRequestContext,
 }
 
-func testDockerContainerCreate(t *testing.T) {
-	type configWrapper struct {
-		*container.Config
-		HostConfig       *container.HostConfig
-		NetworkingConfig *network.NetworkingConfig
-	}
-
-	dockerRequestProcessors["/containers/create"] = func(w http.ResponseWriter, r *http.Request) {
-		if !strings.HasSuffix(r.URL.Path, "/containers/create") {
-			t.Errorf("Unexpected request path: %s", r.URL.Path)
-		}
-
-		var body configWrapper
-		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-			t.Fatal("Failed to decode the JSON body:", err)
-		}
-
-		if body.Image != "test-image" {
-			t.Errorf("Unexpected image: %s", body.Image)
-		}
-
-		if body.Hostname != "filter.host" {
-			t.Errorf("Unexpected hostname: %s", body.Hostname)
-		}
-
-		if !body.HostConfig.NetworkMode.IsContainer() || body.HostConfig.NetworkMode.ConnectedContainer() != "x" {
-			t.Errorf("Unexpected network mode: %s", body.HostConfig.NetworkMode)
-		}
-
-		if !body.HostConfig.PidMode.IsHost() {
-			t.Errorf("Unexpected pid mode: %s", body.HostConfig.PidMode)
-		}
+type configWrapper struct {
+	*container.Config
+	HostConfig       *container.HostConfig
+	NetworkingConfig *network.NetworkingConfig
+}
 
-		w.WriteHeader(200)
-		json.NewEncoder(w).Encode(&container.ContainerCreateCreatedBody{ID: "abcd1234"})
-	}
+func testDockerContainerCreate(t *testing.T) {
+	env := connecttest.New(t)
 
-	dockerProxy.Handle("/containers/create",
-		FilterAsJson(
-			func() T { return &configWrapper{} },
-			func(r T) T {
+	env.Proxy.Handle("/containers/create",
+		connect.FilterAsJson(
+			func() connect.T { return &configWrapper{} },
+			func(r connect.T) connect.T {
 				req := r.(*configWrapper)
 
 				if req.Config == nil || req.HostConfig == nil {
@@ -75,8 +65,9 @@ func testDockerContainerCreate(t *testing.T) {
 				req.HostConfig.PidMode = container.PidMode("host")
 				return req
 			}))
+	env.Start()
 
-	if successfulResponse, err := dockerClient.ContainerCreate(
+	successfulResponse, err := env.Client.ContainerCreate(
 		context.Background(),
 		&container.Config{
 			Image: "test-image",
@@ -86,59 +77,281 @@ func testDockerContainerCreate(t *testing.T) {
 		},
 		&network.NetworkingConfig{},
 		"testing",
-	); err != nil {
-		t.Error("Failed to simulate service create:", err)
-	} else if successfulResponse.ID != "abcd1234" {
+	)
+	if err != nil {
+		t.Fatal("Failed to simulate container create:", err)
+	}
+
+	var body configWrapper
+	if err := env.Daemon.AssertReceived(t, "POST", "/containers/create").DecodeJSON(&body); err != nil {
+		t.Fatal("Failed to decode the JSON body:", err)
+	}
+
+	if body.Image != "test-image" {
+		t.Errorf("Unexpected image: %s", body.Image)
+	}
+
+	if body.Hostname != "filter.host" {
+		t.Errorf("Unexpected hostname: %s", body.Hostname)
+	}
+
+	if !body.HostConfig.NetworkMode.IsContainer() || body.HostConfig.NetworkMode.ConnectedContainer() != "x" {
+		t.Errorf("Unexpected network mode: %s", body.HostConfig.NetworkMode)
+	}
+
+	if !body.HostConfig.PidMode.IsHost() {
+		t.Errorf("Unexpected pid mode: %s", body.HostConfig.PidMode)
+	}
+
+	if created, ok := env.Daemon.Container("testing"); !ok || created.ID != successfulResponse.ID {
 		t.Errorf("Unexpected response: %+v", successfulResponse)
 	}
 
-	if dockerRequestCount != 1 {
-		t.Errorf("Unexpected number of requests: %d", dockerRequestCount)
+	env.Daemon.AssertRequestCount(t, 1)
+}
+
+func testDockerContainerCreateLargePayload(t *testing.T) {
+	env := connecttest.New(t)
+
+	env.Proxy.Handle("/containers/create",
+		connect.FilterAsJson(
+			func() connect.T { return &container.Config{} },
+			func(r connect.T) connect.T {
+				req := r.(*container.Config)
+
+				if req.Labels == nil {
+					req.Labels = map[string]string{}
+				}
+
+				req.Labels["docker.filter.applied"] = "1"
+
+				return req
+			}))
+	env.Start()
+
+	var variables []string
+	for i := 0; i < 2000; i++ {
+		variables = append(variables, fmt.Sprintf("VARIABLE_%04d=some-longer-value-to-fill-the-buffers", i))
+	}
+
+	if _, err := env.Client.ContainerCreate(
+		context.Background(),
+		&container.Config{
+			Image: "test-image",
+			Env:   variables,
+		},
+		&container.HostConfig{},
+		&network.NetworkingConfig{},
+		"large",
+	); err != nil {
+		t.Error("Failed to simulate container create:", err)
 	}
+
+	var body container.Config
+	if err := env.Daemon.AssertReceived(t, "POST", "/containers/create").DecodeJSON(&body); err != nil {
+		t.Fatal("Failed to decode the JSON body:", err)
+	}
+
+	if len(body.Env) != 2000 {
+		t.Errorf("Unexpected number of environment variables: %d", len(body.Env))
+	}
+
+	if body.Labels["docker.filter.applied"] != "1" {
+		t.Error("Missing labels:", body.Labels)
+	}
+
+	env.Daemon.AssertRequestCount(t, 1)
 }
 
-func testDockerServiceCreate(t *testing.T) {
-	dockerRequestProcessors["/services/create"] = func(w http.ResponseWriter, r *http.Request) {
-		if !strings.HasSuffix(r.URL.Path, "/services/create") {
-			t.Errorf("Unexpected request path: %s", r.URL.Path)
+func testDockerPipelinedRequests(t *testing.T) {
+	env := connecttest.New(t)
+
+	env.Daemon.Handle("GET", "/containers/json", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode([]types.Container{{ID: "c1", Image: "secret-image"}})
+	})
+	env.Daemon.Handle("GET", "/images/json", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode([]types.ImageSummary{{ID: "i1"}})
+	})
+
+	var seen []string
+
+	env.Proxy.FilterResponses("/(containers|images)/json", func(resp *http.Response, body []byte) (*http.Response, error) {
+		seen = append(seen, resp.Request.URL.Path)
+		return nil, nil
+	})
+
+	env.Proxy.FilterResponses("/containers/json",
+		connect.FilterResponseAsJson(
+			func() connect.T { return &[]types.Container{} },
+			func(r connect.T) connect.T {
+				containers := *r.(*[]types.Container)
+				for idx := range containers {
+					containers[idx].Image = "redacted"
+				}
+				return containers
+			}))
+	env.Start()
+
+	conn := dialProxy(t, env)
+	defer conn.Close()
+
+	// send all the requests before reading any of the responses
+	for _, path := range []string{"/v1.37/containers/json", "/v1.37/images/json", "/v1.37/containers/json"} {
+		fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: docker\r\n\r\n", path)
+	}
+
+	reader := bufio.NewReader(conn)
+
+	for idx, expected := range []string{"redacted", "i1", "redacted"} {
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal("Failed to read response", idx, ":", err)
 		}
 
-		var body swarm.ServiceSpec
-		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-			t.Fatal("Failed to decode the JSON body:", err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("Unexpected response %d: %s", idx, body)
 		}
+	}
+
+	if strings.Join(seen, ",") != "/v1.37/containers/json,/v1.37/images/json,/v1.37/containers/json" {
+		t.Error("Unexpected requests seen by the response filters:", seen)
+	}
+}
 
-		if body.TaskTemplate.ContainerSpec.Image != "swarm-image:v1" {
-			t.Errorf("Unexpected image: %s", body.TaskTemplate.ContainerSpec.Image)
+func testDockerChunkedRequest(t *testing.T) {
+	env := connecttest.New(t)
+
+	env.Proxy.Handle("/containers/create",
+		connect.FilterAsJson(
+			func() connect.T { return &container.Config{} },
+			func(r connect.T) connect.T {
+				req := r.(*container.Config)
+				req.Labels = map[string]string{"docker.filter.applied": "1"}
+				return req
+			}))
+
+	env.Daemon.Handle("POST", "/build", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.WriteHeader(200)
+		fmt.Fprint(w, len(body), r.TransferEncoding)
+	})
+
+	env.Proxy.SetMaxRequestBodySize(64)
+	env.Start()
+
+	send := func(path string, chunks ...string) *http.Response {
+		conn := dialProxy(t, env)
+		defer conn.Close()
+
+		fmt.Fprint(conn, "POST "+path+" HTTP/1.1\r\nHost: docker\r\n"+
+			"Content-Type: application/json\r\nTransfer-Encoding: chunked\r\n\r\n")
+		for _, chunk := range chunks {
+			fmt.Fprintf(conn, "%x\r\n%s\r\n", len(chunk), chunk)
 		}
+		fmt.Fprint(conn, "0\r\n\r\n")
 
-		if body.Name != "test-svc" {
-			t.Errorf("Unexpected name: %s", body.Name)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal("Failed to read the response:", err)
 		}
 
-		if body.Labels["docker.filter.applied"] != "1" {
-			t.Error("Missing labels:", body.Labels)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		return resp
+	}
+
+	if resp := send("/containers/create", `{"Image":`, `"alpine"}`); resp.StatusCode != http.StatusCreated {
+		t.Error("Unexpected response for the chunked request: HTTP", resp.StatusCode)
+	}
+
+	resp := send("/containers/create", `{"Image":"alpine",`, `"Env":["`+strings.Repeat("A", 64)+`"]}`)
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Error("Unexpected response for the request over the size limit: HTTP", resp.StatusCode)
+	}
+	if !resp.Close {
+		t.Error("Expected the connection to be closed after the request over the size limit")
+	}
+
+	received := env.Daemon.Received("POST", "/containers/create")
+	if len(received) != 1 {
+		t.Fatal("Unexpected number of requests on the daemon:", len(received))
+	}
+
+	var body container.Config
+	if err := received[0].DecodeJSON(&body); err != nil {
+		t.Fatal("Failed to decode the JSON body:", err)
+	}
+
+	if body.Image != "alpine" || body.Labels["docker.filter.applied"] != "1" {
+		t.Errorf("Unexpected request: %+v", body)
+	}
+
+	// the bodies no request filter reads are streamed as they are, without the size limit
+	resp = send("/build", strings.Repeat("B", 100), strings.Repeat("C", 100))
+	if content, _ := ioutil.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(content) != "200 [chunked]" {
+		t.Errorf("Unexpected response for the unfiltered request: HTTP %d %s", resp.StatusCode, content)
+	}
+}
+
+func testDockerUpgradeNotAccepted(t *testing.T) {
+	env := connecttest.New(t)
+
+	env.Proxy.On("POST", "/containers/create", func(req *http.Request, body []byte) (*http.Request, error) {
+		return nil, connect.NewDenial(http.StatusForbidden, "denied by the test")
+	})
+	env.Start()
+
+	conn := dialProxy(t, env)
+	defer conn.Close()
+
+	// the daemon does not upgrade the connection, so the pipelined request has to be filtered
+	body := `{"Image":"alpine"}`
+	fmt.Fprint(conn, "GET /_ping HTTP/1.1\r\nHost: docker\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n"+
+		"POST /containers/create HTTP/1.1\r\nHost: docker\r\nContent-Type: application/json\r\n"+
+		fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(body), body))
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	for _, expected := range []int{http.StatusOK, http.StatusForbidden} {
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal("Failed to read the response:", err)
 		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
 
-		w.WriteHeader(200)
-		json.NewEncoder(w).Encode(&types.ServiceCreateResponse{
-			ID: "created.svc",
-		})
+		if resp.StatusCode != expected {
+			t.Errorf("Unexpected response: HTTP %d instead of %d", resp.StatusCode, expected)
+		}
 	}
 
+	env.Daemon.AssertNotReceived(t, "POST", "/containers/create")
+}
+
+func testDockerServiceCreate(t *testing.T) {
+	env := connecttest.New(t)
+
 	var (
 		memMaxLimit, _ = units.RAMInBytes("512M")
 		mem64M, _      = units.RAMInBytes("64M")
 	)
 
-	dockerProxy.Handle("/services/create",
-		FilterAsJson(
-			func() T { return &swarm.ServiceSpec{} },
-			func(r T) T {
+	env.Proxy.Handle("/services/create",
+		connect.FilterAsJson(
+			func() connect.T { return &swarm.ServiceSpec{} },
+			func(r connect.T) connect.T {
 				req := r.(*swarm.ServiceSpec)
 
 				if strings.Contains(req.TaskTemplate.ContainerSpec.Image, ":latest") {
-					panic(NewCriticalFailure("do not use the latest tag", "Policy"))
+					panic(connect.NewCriticalFailure("do not use the latest tag", "Policy"))
 				}
 
 				if req.TaskTemplate.Resources == nil ||
@@ -146,7 +359,7 @@ func testDockerServiceCreate(t *testing.T) {
 					req.TaskTemplate.Resources.Limits.MemoryBytes <= 0 ||
 					req.TaskTemplate.Resources.Limits.MemoryBytes > memMaxLimit {
 
-					panic(NewCriticalFailure("missing or too high memory limits", "Resources"))
+					panic(connect.NewCriticalFailure("missing or too high memory limits", "Resources"))
 				}
 
 				if req.Labels == nil {
@@ -157,8 +370,9 @@ func testDockerServiceCreate(t *testing.T) {
 
 				return req
 			}))
+	env.Start()
 
-	successfulResponse, err := dockerClient.ServiceCreate(
+	successfulResponse, err := env.Client.ServiceCreate(
 		context.Background(),
 		swarm.ServiceSpec{
 			TaskTemplate: swarm.TaskSpec{
@@ -180,13 +394,29 @@ func testDockerServiceCreate(t *testing.T) {
 	if err != nil {
 		t.Error("Failed to simulate service create:", err)
 	}
-	if successfulResponse.ID != "created.svc" {
-		t.Error("Unexpected ID in response:", successfulResponse.ID)
+
+	var body swarm.ServiceSpec
+	if err := env.Daemon.AssertReceived(t, "POST", "/services/create").DecodeJSON(&body); err != nil {
+		t.Fatal("Failed to decode the JSON body:", err)
+	}
+
+	if body.TaskTemplate.ContainerSpec.Image != "swarm-image:v1" {
+		t.Errorf("Unexpected image: %s", body.TaskTemplate.ContainerSpec.Image)
 	}
 
-	SetLogLevel(LogLevel_NONE)
+	if body.Name != "test-svc" {
+		t.Errorf("Unexpected name: %s", body.Name)
+	}
+
+	if body.Labels["docker.filter.applied"] != "1" {
+		t.Error("Missing labels:", body.Labels)
+	}
+
+	if service, ok := env.Daemon.Service("test-svc"); !ok || service.ID != successfulResponse.ID {
+		t.Error("Unexpected ID in response:", successfulResponse.ID)
+	}
 
-	if _, err := dockerClient.ServiceCreate(
+	if _, err := env.Client.ServiceCreate(
 		context.Background(),
 		swarm.ServiceSpec{
 			TaskTemplate: swarm.TaskSpec{
@@ -204,7 +434,7 @@ func testDockerServiceCreate(t *testing.T) {
 		t.Error("Failing request (1) was successful")
 	}
 
-	if _, err := dockerClient.ServiceCreate(
+	if _, err := env.Client.ServiceCreate(
 		context.Background(),
 		swarm.ServiceSpec{
 			TaskTemplate: swarm.TaskSpec{
@@ -222,39 +452,28 @@ func testDockerServiceCreate(t *testing.T) {
 		t.Error("Failing request (2) was successful")
 	}
 
-	if dockerRequestCount != 1 {
-		t.Errorf("Unexpected number of requests: %d", dockerRequestCount)
-	}
+	env.Daemon.AssertRequestCount(t, 1)
 }
 
 func testDockerServiceUpdate(t *testing.T) {
-	dockerRequestProcessors["/"] = func(w http.ResponseWriter, r *http.Request) {
-		if !regexp.MustCompile("/services/.+/update").MatchString(r.URL.Path) {
-			t.Errorf("Unexpected request path: %s", r.URL.Path)
-		}
-
-		var body swarm.ServiceSpec
-		json.NewDecoder(r.Body).Decode(&body)
-
-		if body.Labels["docker.filter.applied"] != "1" {
-			t.Error("Missing labels:", body.Labels)
-		}
+	env := connecttest.New(t)
 
+	env.Daemon.Handle("POST", "/services/{id}/update", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(200)
 		json.NewEncoder(w).Encode(&types.ServiceUpdateResponse{})
-	}
+	})
 
-	dockerProxy.Handle("/services/.+/update", func(req *http.Request, body []byte) (*http.Request, error) {
+	env.Proxy.Handle("/services/.+/update", func(req *http.Request, body []byte) (*http.Request, error) {
 		if req.URL.Query().Get("rollback") != "previous" {
-			panic(NewCriticalFailure("no or invalid rollback policy set", "Policy"))
+			panic(connect.NewCriticalFailure("no or invalid rollback policy set", "Policy"))
 		}
 		return nil, nil
 	})
 
-	dockerProxy.Handle("/services/.+/update", func(httpReq *http.Request, body []byte) (*http.Request, error) {
-		return FilterAsJson(
-			func() T { return &swarm.ServiceSpec{} },
-			func(r T) T {
+	env.Proxy.Handle("/services/.+/update", func(httpReq *http.Request, body []byte) (*http.Request, error) {
+		return connect.FilterAsJson(
+			func() connect.T { return &swarm.ServiceSpec{} },
+			func(r connect.T) connect.T {
 				req := r.(*swarm.ServiceSpec)
 
 				if req.Mode.Replicated != nil {
@@ -265,7 +484,7 @@ func testDockerServiceUpdate(t *testing.T) {
 							MustCompile(".*/services/(.+)/update.*").
 							ReplaceAllString(httpReq.URL.Path, "$1")
 
-						panic(NewSoftFailure(fmt.Sprintf(
+						panic(connect.NewSoftFailure(fmt.Sprintf(
 							"consider running at least 3 replicas of the '%s' service", serviceId),
 							"Advice"))
 					}
@@ -275,10 +494,10 @@ func testDockerServiceUpdate(t *testing.T) {
 			})(httpReq, body)
 	})
 
-	dockerProxy.Handle("/services/.+/update",
-		FilterAsJson(
-			func() T { return &swarm.ServiceSpec{} },
-			func(r T) T {
+	env.Proxy.Handle("/services/.+/update",
+		connect.FilterAsJson(
+			func() connect.T { return &swarm.ServiceSpec{} },
+			func(r connect.T) connect.T {
 				req := r.(*swarm.ServiceSpec)
 
 				if req.Labels == nil {
@@ -289,11 +508,10 @@ func testDockerServiceUpdate(t *testing.T) {
 
 				return req
 			}))
-
-	SetLogLevel(LogLevel_NONE)
+	env.Start()
 
 	two := uint64(2)
-	successfulResponse, err := dockerClient.ServiceUpdate(
+	successfulResponse, err := env.Client.ServiceUpdate(
 		context.Background(),
 		"to_update",
 		swarm.Version{Index: 12},
@@ -312,7 +530,7 @@ func testDockerServiceUpdate(t *testing.T) {
 		t.Error("Failed to update service:", err)
 	}
 
-	if _, err := dockerClient.ServiceUpdate(
+	if _, err := env.Client.ServiceUpdate(
 		context.Background(),
 		"failing",
 		swarm.Version{Index: 13},
@@ -325,86 +543,380 @@ func testDockerServiceUpdate(t *testing.T) {
 	} else {
 		t.Error("Failing request was successful")
 	}
+
+	var body swarm.ServiceSpec
+	if err := env.Daemon.AssertReceived(t, "POST", "/services/to_update/update").DecodeJSON(&body); err != nil {
+		t.Fatal("Failed to decode the JSON body:", err)
+	}
+
+	if body.Labels["docker.filter.applied"] != "1" {
+		t.Error("Missing labels:", body.Labels)
+	}
+
+	env.Daemon.AssertNotReceived(t, "POST", "/services/failing/update")
 }
 
-var (
-	dockerClient   *client.Client
-	dockerServer   *httptest.Server
-	dockerListener net.Listener
-	dockerProxy    *Proxy
+func testDockerPathTemplates(t *testing.T) {
+	env := connecttest.New(t)
 
-	dockerRequestProcessors = map[string]dockerRequestProcessor{}
-	dockerRequestCount      int
-)
+	env.Daemon.Handle("*", "/{path:.+}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte("{}"))
+	})
+
+	var calls []string
+
+	env.Proxy.On("POST", "/services/{id}/update", func(req *http.Request, body []byte) (*http.Request, error) {
+		calls = append(calls, "update:"+connect.PathParams(req)["id"])
+		return nil, nil
+	})
+	env.Proxy.On("POST", "/services/{id}/update", connect.FilterRequestAsJson(
+		func() connect.T { return &swarm.ServiceSpec{} },
+		func(r connect.T) connect.T { return r }))
+	env.Proxy.FilterRequests("/services/.+/update", func(req *http.Request, body []byte) (*http.Request, error) {
+		// the parameters of the earlier handlers are not carried over with the changed request
+		calls = append(calls, fmt.Sprintf("regexp:%d", len(connect.PathParams(req))))
+		return nil, nil
+	})
+	env.Proxy.On("GET", "/services/{id}", func(req *http.Request, body []byte) (*http.Request, error) {
+		calls = append(calls, "inspect:"+connect.PathParams(req)["id"])
+		return nil, nil
+	})
+	env.Proxy.OnResponse("*", "/images/{name:.+}/json", func(resp *http.Response, body []byte) (*http.Response, error) {
+		calls = append(calls, "image:"+connect.PathParams(resp.Request)["name"])
+		return nil, nil
+	})
+	env.Start()
+
+	env.Client.ServiceUpdate(
+		context.Background(), "svc-1", swarm.Version{Index: 1}, swarm.ServiceSpec{}, types.ServiceUpdateOptions{})
+	env.Client.ServiceInspectWithRaw(
+		context.Background(), "svc-2", types.ServiceInspectOptions{})
+	env.Client.ImageInspectWithRaw(
+		context.Background(), "library/alpine:3.8")
+
+	if strings.Join(calls, ",") != "update:svc-1,regexp:0,inspect:svc-2,image:library/alpine:3.8" {
+		t.Error("Unexpected filter calls:", calls)
+	}
+
+	env.Daemon.AssertReceived(t, "GET", "/images/{name:.+}/json")
+}
+
+func testDockerDirectResponses(t *testing.T) {
+	env := connecttest.New(t)
+
+	env.Daemon.Handle("GET", "/containers/json", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode([]types.Container{{ID: "original"}})
+	})
+
+	env.Proxy.On("GET", "/_ping", func(req *http.Request, body []byte) (*http.Request, error) {
+		return nil, connect.NewDirectResponse(connect.NewResponse(200, "text/plain", []byte("OK")))
+	})
+	env.Proxy.On("GET", "/version", func(req *http.Request, body []byte) (*http.Request, error) {
+		panic(connect.NewDirectResponse(connect.NewJsonResponse(200, &types.Version{Version: "virtual"})))
+	})
+	env.Proxy.OnResponse("GET", "/containers/json", func(resp *http.Response, body []byte) (*http.Response, error) {
+		return connect.NewJsonResponse(200, []types.Container{{ID: "replaced"}}), nil
+	})
+	env.Start()
+
+	if _, err := env.Client.Ping(context.Background()); err != nil {
+		t.Error("Failed to ping:", err)
+	}
+
+	if version, err := env.Client.ServerVersion(context.Background()); err != nil {
+		t.Error("Failed to get the version:", err)
+	} else if version.Version != "virtual" {
+		t.Error("Unexpected version:", version.Version)
+	}
+
+	env.Daemon.AssertRequestCount(t, 0)
+
+	conn := dialProxy(t, env)
+	defer conn.Close()
+
+	// the connection is kept alive for the next requests
+	for _, path := range []string{"/v1.37/version", "/v1.37/info", "/v1.37/_ping"} {
+		fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: docker\r\n\r\n", path)
+	}
+
+	reader := bufio.NewReader(conn)
+
+	for idx, expected := range []string{"virtual", "connecttest", "OK"} {
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal("Failed to read response", idx, ":", err)
+		}
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != 200 || resp.Close || !strings.Contains(string(body), expected) {
+			t.Errorf("Unexpected response %d: HTTP %d %s", idx, resp.StatusCode, body)
+		}
+	}
 
-type dockerRequestProcessor func(w http.ResponseWriter, r *http.Request)
+	env.Daemon.AssertRequestCount(t, 1)
 
-func onDockerSetup() error {
-	SetLogLevel(LogLevel_WARN)
+	// response filters can replace the response of the remote with a new one too
+	if containers, err := env.Client.ContainerList(context.Background(), types.ContainerListOptions{}); err != nil {
+		t.Error("Failed to list the containers:", err)
+	} else if len(containers) != 1 || containers[0].ID != "replaced" {
+		t.Errorf("Unexpected containers: %+v", containers)
+	}
+}
 
-	dockerRequestCount = 0
+func testDockerDenials(t *testing.T) {
+	env := connecttest.New(t)
 
-	for k := range dockerRequestProcessors {
-		delete(dockerRequestProcessors, k)
+	env.Proxy.On("DELETE", "/containers/{id}", func(req *http.Request, body []byte) (*http.Request, error) {
+		return nil, connect.NewDenial(409, `container "`+connect.PathParams(req)["id"]+`" is protected`)
+	})
+	env.Proxy.On("GET", "/images/json", func(req *http.Request, body []byte) (*http.Request, error) {
+		panic(connect.NewSoftFailure("listing images is not allowed", "Policy").WithStatus(400))
+	})
+	env.Proxy.On("POST", "/containers/{id}/kill", func(req *http.Request, body []byte) (*http.Request, error) {
+		return nil, connect.NewCriticalFailure("not allowed to kill containers", "Security")
+	})
+	env.Start()
+
+	if err := env.Client.ContainerRemove(
+		context.Background(), "db", types.ContainerRemoveOptions{},
+	); err == nil || !strings.Contains(err.Error(), `container "db" is protected`) {
+		t.Error("Unexpected error:", err)
 	}
 
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		for pattern, process := range dockerRequestProcessors {
-			if regexp.MustCompile(pattern).MatchString(r.URL.Path) {
-				process(w, r)
-				dockerRequestCount += 1
+	conn := dialProxy(t, env)
+	defer conn.Close()
+
+	for _, request := range []string{"GET /v1.37/images/json", "GET /v1.37/info", "POST /v1.37/containers/x/kill", "GET /v1.37/info"} {
+		fmt.Fprintf(conn, "%s HTTP/1.1\r\nHost: docker\r\nContent-Length: 0\r\n\r\n", request)
+	}
+
+	reader := bufio.NewReader(conn)
+
+	for idx, expected := range []struct {
+		status  int
+		message string
+		close   bool
+	}{
+		{400, "Policy: listing images is not allowed", false},
+		{200, "", false},
+		{403, "Security: not allowed to kill containers", true},
+	} {
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal("Failed to read response", idx, ":", err)
+		}
+
+		var body struct{ Message string }
+		json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+
+		if resp.StatusCode != expected.status || body.Message != expected.message || resp.Close != expected.close {
+			t.Errorf("Unexpected response %d: HTTP %d %+v (close: %v)", idx, resp.StatusCode, body, resp.Close)
+		}
+	}
+
+	if _, err := http.ReadResponse(reader, nil); err == nil {
+		t.Error("Expected the connection to be closed after the critical failure")
+	}
+
+	env.Daemon.AssertRequestCount(t, 1)
+}
+
+func testDockerStreamingEvents(t *testing.T) {
+	env := connecttest.New(t)
+
+	// the daemon waits for its handlers when it is closed
+	finish := make(chan struct{})
+	defer close(finish)
+
+	env.Daemon.Handle("GET", "/events", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+
+		encoder := json.NewEncoder(w)
+		for _, actor := range []string{"other-tenant", "own-1", "own-2"} {
+			encoder.Encode(&events.Message{Type: "container", Action: "start", Actor: events.Actor{ID: actor}})
+			w.(http.Flusher).Flush()
+		}
+
+		<-finish
+	})
+
+	env.Proxy.OnResponseStream("GET", "/events",
+		connect.FilterStreamAsJson(
+			func() connect.T { return &events.Message{} },
+			func(m connect.T) connect.T {
+				message := m.(*events.Message)
+				if !strings.HasPrefix(message.Actor.ID, "own-") {
+					panic(connect.DropChunk)
+				}
+
+				message.Actor.Attributes = map[string]string{"filtered": "1"}
+				return message
+			}))
+	env.Start()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	messages, errs := env.Client.Events(ctx, types.EventsOptions{})
+
+	for _, expected := range []string{"own-1", "own-2"} {
+		select {
+		case message := <-messages:
+			if message.Actor.ID != expected || message.Actor.Attributes["filtered"] != "1" {
+				t.Errorf("Unexpected event: %+v", message)
 			}
+
+		case err := <-errs:
+			t.Fatal("Failed to receive events:", err)
+
+		case <-time.After(2 * time.Second):
+			t.Fatal("Timed out waiting for streamed events")
 		}
-	}))
-	dockerServer = server
+	}
+}
 
-	listener, err := net.Listen("tcp", "127.0.0.1:0")
-	if err != nil {
-		return err
+func testDockerExecAndLogsFrames(t *testing.T) {
+	env := connecttest.New(t)
+
+	writeFrame := func(w io.Writer, stream byte, data string) {
+		header := []byte{stream, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(header[4:], uint32(len(data)))
+		w.Write(append(header, data...))
 	}
-	dockerListener = listener
 
-	proxy := NewProxy(func() (net.Conn, error) {
-		return net.Dial(server.Listener.Addr().Network(), server.Listener.Addr().String())
+	// larger than the frames buffered for the filters, so it is passed through as it is
+	oversized := strings.Repeat("x", 1<<20) + "secret\n"
+
+	env.Daemon.Handle("POST", "/exec/{id}/start", func(w http.ResponseWriter, r *http.Request) {
+		conn, buffered, _ := w.(http.Hijacker).Hijack()
+		defer conn.Close()
+
+		buffered.WriteString("HTTP/1.1 101 UPGRADED\r\n" +
+			"Content-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+		writeFrame(buffered, 1, "password=secret\n")
+		writeFrame(buffered, 2, "warning\n")
+		buffered.Flush()
+
+		input, _ := buffered.ReadString('\n')
+		writeFrame(buffered, 1, "got:"+input)
+		buffered.Flush()
 	})
-	proxy.AddListener("test", listener)
+	env.Daemon.Handle("GET", "/containers/{id}/logs", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.docker.raw-stream")
+		w.WriteHeader(200)
+		writeFrame(w, 1, "token=secret\n")
+		writeFrame(w, 1, oversized)
+		writeFrame(w, 2, "done\n")
+	})
+
+	redact := func(req *http.Request, frame *connect.Frame) (*connect.Frame, error) {
+		if frame.Stream == connect.Stdin && strings.Contains(string(frame.Data), "forbidden") {
+			return nil, connect.DropChunk
+		}
 
-	go proxy.Process()
+		if frame.Stream == connect.Stdout {
+			return &connect.Frame{Stream: connect.Stdout, Data: []byte(strings.Replace(string(frame.Data), "secret", "***", -1))}, nil
+		}
 
-	dockerProxy = proxy
+		return nil, nil
+	}
 
-	cli, err := client.NewClientWithOpts(
-		client.WithHTTPClient(server.Client()),
-		client.WithHost("tcp://"+listener.Addr().String()),
-	)
+	env.Proxy.OnFrames("POST", "/exec/{id}/start", redact)
+	env.Proxy.OnFrames("GET", "/containers/{id}/logs", redact)
+	env.Start()
+
+	attached, err := env.Client.ContainerExecAttach(context.Background(), "exec-1", types.ExecStartCheck{})
+	if err != nil {
+		t.Fatal("Failed to attach to the exec session:", err)
+	}
+	defer attached.Close()
+
+	attached.Conn.Write([]byte("forbidden\n"))
+	time.Sleep(50 * time.Millisecond)
+	attached.Conn.Write([]byte("allowed\n"))
+
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	if _, err := stdcopy.StdCopy(stdout, stderr, attached.Reader); err != nil {
+		t.Error("Failed to read the exec output:", err)
+	}
+
+	if stdout.String() != "password=***\ngot:allowed\n" || stderr.String() != "warning\n" {
+		t.Errorf("Unexpected exec output: %q %q", stdout.String(), stderr.String())
+	}
+
+	logs, err := env.Client.ContainerLogs(context.Background(), "c1", types.ContainerLogsOptions{ShowStdout: true})
 	if err != nil {
-		return err
+		t.Fatal("Failed to get the logs:", err)
 	}
-	dockerClient = cli
+	defer logs.Close()
 
-	return nil
+	stdout.Reset()
+	stderr.Reset()
+	if _, err := stdcopy.StdCopy(stdout, stderr, logs); err != nil {
+		t.Error("Failed to read the logs:", err)
+	}
+
+	if stdout.String() != "token=***\n"+oversized || stderr.String() != "done\n" {
+		t.Errorf("Unexpected logs: %d bytes, %q", stdout.Len(), stderr.String())
+	}
 }
 
-func onDockerTearDown() {
-	if dockerClient != nil {
-		dockerClient.Close()
+func testDockerRequestContext(t *testing.T) {
+	env := connecttest.New(t)
+
+	var seen []*connect.RequestContext
+
+	env.Proxy.On("*", "/info", func(req *http.Request, body []byte) (*http.Request, error) {
+		connect.ContextOf(req).Set("policy", "allowed-by-test")
+		return nil, nil
+	})
+	env.Proxy.OnResponse("*", "/info", func(resp *http.Response, body []byte) (*http.Response, error) {
+		rc := connect.ContextOf(resp.Request)
+		if value, _ := rc.Get("policy"); value != "allowed-by-test" {
+			t.Error("Unexpected value in the context:", value)
+		}
+
+		seen = append(seen, rc)
+		return nil, nil
+	})
+	env.Start()
+
+	env.Client.Info(context.Background())
+	env.Client.Info(context.Background())
+
+	if len(seen) != 2 {
+		t.Fatal("Unexpected number of responses:", len(seen))
+	}
+
+	for _, rc := range seen {
+		if rc.Listener != "test" || rc.ConnectionID <= 0 || rc.RemoteAddr == "" || rc.Client == nil || rc.RequestID == "" {
+			t.Errorf("Unexpected request context: %+v", rc)
+		}
 	}
-	if dockerListener != nil {
-		dockerListener.Close()
+
+	if seen[0].RequestID == seen[1].RequestID {
+		t.Error("Request IDs are not unique:", seen[0].RequestID)
 	}
-	if dockerServer != nil {
-		dockerServer.Close()
+}
+
+// dialProxy connects to the proxy of the environment, to send raw requests on the connection.
+func dialProxy(t *testing.T, env *connecttest.Env) net.Conn {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(env.Address(), "tcp://"))
+	if err != nil {
+		t.Fatal("Failed to connect to the proxy:", err)
 	}
+
+	return conn
 }
 
 func TestDockerMessages(t *testing.T) {
 	for name, testFunc := range dockerTestCases {
-		if err := onDockerSetup(); err != nil {
-			panic(err)
-		}
-
 		t.Run(name, testFunc)
-
-		onDockerTearDown()
 	}
 }
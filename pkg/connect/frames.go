@@ -0,0 +1,301 @@
+package connect
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+type StreamType byte
+
+const (
+	Stdin  StreamType = 0
+	Stdout StreamType = 1
+	Stderr StreamType = 2
+)
+
+// Frame is a piece of an attached stream, either a frame of the multiplexed
+// stdout/stderr output, or a chunk of stdin or raw (TTY) output as it arrives.
+type Frame struct {
+	Stream StreamType
+	Data   []byte
+}
+
+type FrameFilterFunc func(req *http.Request, frame *Frame) (*Frame, error)
+
+const (
+	frameHeaderSize = 8
+
+	// larger frames are passed through without buffering them for the filters
+	maxFilteredFrameSize = 1 << 20
+)
+
+// FilterFrames registers a filter for the streams of attach, exec and logs requests, in both directions.
+// Returning (or panicking with) DropChunk leaves the frame out of the stream.
+func (p *Proxy) FilterFrames(urlPattern string, filterFunc FrameFilterFunc) {
+	p.addHandler(&handler{
+		path:        urlPattern,
+		pattern:     regexp.MustCompile(urlPattern),
+		frameFilter: filterFunc,
+	})
+}
+
+// OnFrames registers a frame filter with a method and path template, see On.
+func (p *Proxy) OnFrames(method, pathTemplate string, filterFunc FrameFilterFunc) {
+	p.addHandler(&handler{
+		method:      method,
+		path:        pathTemplate,
+		pattern:     CompilePathTemplate(pathTemplate),
+		frameFilter: filterFunc,
+	})
+}
+
+type boundFrameFilter struct {
+	handler *handler
+	request *http.Request
+}
+
+func frameFiltersFor(handlers []*handler, request *http.Request) []*boundFrameFilter {
+	var filters []*boundFrameFilter
+
+	for _, handler := range handlers {
+		if handler.frameFilter == nil {
+			continue
+		}
+
+		if params, ok := handler.match(request); ok {
+			filters = append(filters, &boundFrameFilter{
+				handler: handler,
+				request: withPathParams(request, params),
+			})
+		}
+	}
+
+	return filters
+}
+
+// filterInputFrames wraps the stdin stream of an upgraded connection if there are frame filters for it.
+func (cp *connectionPair) filterInputFrames(source *bufio.Reader, ex *exchange) io.Reader {
+	filters := frameFiltersFor(ex.handlers, ex.request)
+	if len(filters) == 0 {
+		return source
+	}
+
+	return &frameFilteringReader{
+		cp:      cp,
+		source:  source,
+		filters: filters,
+		stream:  Stdin,
+		detect:  func() bool { return false },
+	}
+}
+
+// filterOutputFrames wraps the stdout/stderr stream of an upgraded connection or a logs response.
+func (cp *connectionPair) filterOutputFrames(source *bufio.Reader, ex *exchange, response *http.Response) io.Reader {
+	filters := frameFiltersFor(ex.handlers, ex.request)
+	if len(filters) == 0 {
+		return source
+	}
+
+	return &frameFilteringReader{
+		cp:      cp,
+		source:  source,
+		filters: filters,
+		stream:  Stdout,
+		detect:  func() bool { return isMultiplexedStream(source, ex, response) },
+	}
+}
+
+func (cp *connectionPair) filterResponseFrames(ex *exchange, response *http.Response) {
+	if len(frameFiltersFor(ex.handlers, ex.request)) == 0 {
+		return
+	}
+
+	body := response.Body
+	response.Body = struct {
+		io.Reader
+		io.Closer
+	}{cp.filterOutputFrames(bufio.NewReader(body), ex, response), body}
+
+	makeChunked(response)
+}
+
+func isMultiplexedStream(source *bufio.Reader, ex *exchange, response *http.Response) bool {
+	switch response.Header.Get("Content-Type") {
+	case "application/vnd.docker.multiplexed-stream":
+		return true
+	}
+
+	// exec sessions tell whether they use a TTY in the start request
+	var execStart struct{ Tty *bool }
+	if json.Unmarshal(ex.requestBody, &execStart) == nil && execStart.Tty != nil {
+		return !*execStart.Tty
+	}
+
+	// otherwise look for a valid frame header, which raw TTY output is unlikely to start with
+	header, _ := source.Peek(1)
+	if len(header) == 0 || header[0] > byte(Stderr) {
+		return false
+	}
+
+	header, _ = source.Peek(source.Buffered())
+	for idx := 1; idx < 4 && idx < len(header); idx++ {
+		if header[idx] != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+type frameFilteringReader struct {
+	cp *connectionPair
+
+	source  *bufio.Reader
+	filters []*boundFrameFilter
+	stream  StreamType
+
+	detect      func() bool
+	multiplexed *bool
+
+	pending    []byte
+	unfiltered int64
+	err        error
+}
+
+func (r *frameFilteringReader) Read(b []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.unfiltered > 0 {
+			return r.readUnfiltered(b)
+		}
+
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		frame, err := r.next()
+		if frame != nil {
+			r.pending, r.err = r.apply(frame)
+		}
+		if r.err == nil {
+			r.err = err
+		}
+	}
+
+	n := copy(b, r.pending)
+	r.pending = r.pending[n:]
+
+	return n, nil
+}
+
+func (r *frameFilteringReader) next() (*Frame, error) {
+	if r.multiplexed == nil {
+		// decided on the first read, so that waiting for the output does not hold up anything else
+		multiplexed := r.detect()
+		r.multiplexed = &multiplexed
+	}
+
+	if !*r.multiplexed {
+		chunk := make([]byte, streamChunkSize)
+		n, err := r.source.Read(chunk)
+		if n == 0 {
+			return nil, err
+		}
+
+		return &Frame{Stream: r.stream, Data: chunk[:n]}, err
+	}
+
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(r.source, header); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[4:])
+	if size > maxFilteredFrameSize {
+		r.cp.warn("Passing through a frame of", size, "bytes without filtering on", r.filters[0].request.URL.Path)
+
+		r.pending, r.unfiltered = header, int64(size)
+		return nil, nil
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r.source, data); err != nil {
+		return nil, err
+	}
+
+	return &Frame{Stream: StreamType(header[0]), Data: data}, nil
+}
+
+// readUnfiltered copies the rest of an oversized frame from the source as it arrives.
+func (r *frameFilteringReader) readUnfiltered(b []byte) (int, error) {
+	if int64(len(b)) > r.unfiltered {
+		b = b[:r.unfiltered]
+	}
+
+	n, err := r.source.Read(b)
+	r.unfiltered -= int64(n)
+
+	if err == io.EOF && r.unfiltered > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
+
+func (r *frameFilteringReader) apply(frame *Frame) ([]byte, error) {
+	for _, filter := range r.filters {
+		requestUrl := filter.request.URL.Path
+
+		if changed, err := r.cp.runFrameHandler(filter.handler, filter.request, frame); err != nil {
+			if err == DropChunk {
+				return nil, nil
+			} else if _, ok := err.(SoftFailure); ok {
+				r.cp.warn("Frame filter warning on", requestUrl, ":", err)
+			} else {
+				r.cp.error("Critical:", "Failed to execute frame filter on", requestUrl, ":", err)
+				return nil, err
+			}
+
+		} else if changed != nil {
+			frame = changed
+
+		}
+	}
+
+	if !*r.multiplexed {
+		return frame.Data, nil
+	}
+
+	encoded := make([]byte, frameHeaderSize, frameHeaderSize+len(frame.Data))
+	encoded[0] = byte(frame.Stream)
+	binary.BigEndian.PutUint32(encoded[4:], uint32(len(frame.Data)))
+
+	return append(encoded, frame.Data...), nil
+}
+
+func (cp *connectionPair) runFrameHandler(handler *handler, request *http.Request, frame *Frame) (changed *Frame, err error) {
+	started := time.Now()
+	defer func() { cp.proxy.metrics.filterExecuted("frame", started, changed != nil, err) }()
+
+	defer func() {
+		if r := recover(); r != nil {
+			if r == DropChunk {
+				err = DropChunk
+				return
+			}
+
+			switch r.(type) {
+			case SoftFailure, CriticalFailure, Denial:
+				err = r.(error)
+			default:
+				err = NewCriticalFailure(r, "FrameFilter")
+			}
+		}
+	}()
+
+	return handler.frameFilter(request, frame)
+}
@@ -0,0 +1,77 @@
+package connect
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+)
+
+// ClientIdentity describes who is on the other end of a local connection, as far as the proxy can tell.
+type ClientIdentity struct {
+	// Credentials of the peer process, on Unix socket listeners where the OS supports it
+	Credentials *PeerCredentials
+
+	// Verified client certificate and its subject on TLS listeners
+	Certificate *x509.Certificate
+	Subject     string
+	CommonName  string
+	SANs        []string
+}
+
+type PeerCredentials struct {
+	Uid int
+	Gid int
+	Pid int
+}
+
+// ClientOf returns the identity of the client that sent the request (or the response's request),
+// never nil, but its fields are only set when the listener could identify the client.
+func ClientOf(req *http.Request) *ClientIdentity {
+	if client := ContextOf(req).Client; client != nil {
+		return client
+	}
+
+	return &ClientIdentity{}
+}
+
+func identifyClient(conn net.Conn) (*ClientIdentity, error) {
+	client := &ClientIdentity{}
+
+	if unixConn, ok := conn.(*net.UnixConn); ok {
+		client.Credentials = peerCredentials(unixConn)
+	}
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		certificate, err := verifiedClientCertificate(tlsConn)
+		if err != nil {
+			return nil, err
+		}
+
+		if certificate != nil {
+			client.Certificate = certificate
+			client.Subject = certificate.Subject.String()
+			client.CommonName = certificate.Subject.CommonName
+			client.SANs = subjectAlternativeNames(certificate)
+		}
+	}
+
+	return client, nil
+}
+
+func subjectAlternativeNames(certificate *x509.Certificate) []string {
+	var names []string
+
+	names = append(names, certificate.DNSNames...)
+	names = append(names, certificate.EmailAddresses...)
+
+	for _, ip := range certificate.IPAddresses {
+		names = append(names, ip.String())
+	}
+
+	for _, uri := range certificate.URIs {
+		names = append(names, uri.String())
+	}
+
+	return names
+}
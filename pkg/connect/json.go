@@ -25,12 +25,12 @@ func FilterAsJson(provideValue func() T, change func(T) T) FilterFunc {
 			}
 
 			if body, err = json.Marshal(v); err != nil {
-				return nil, NewCriticalFailure(err, "JSON")
+				return nil, NewCriticalFailure(err, "JSON").WithStatus(http.StatusInternalServerError)
 			}
 
 			res, err := http.NewRequest(req.Method, req.URL.String(), bytes.NewReader(body))
 			if err != nil {
-				return nil, NewCriticalFailure(err, "JSON")
+				return nil, NewCriticalFailure(err, "JSON").WithStatus(http.StatusInternalServerError)
 			}
 
 			for headerName, headerValues := range req.Header {
@@ -39,9 +39,11 @@ func FilterAsJson(provideValue func() T, change func(T) T) FilterFunc {
 				}
 			}
 
-			return res, nil
+			res.Host = req.Host
+
+			return res.WithContext(req.Context()), nil
 		} else {
-			return nil, NewCriticalFailure(err, "JSON")
+			return nil, NewCriticalFailure(err, "JSON").WithStatus(http.StatusBadRequest)
 		}
 	}
 }
@@ -58,7 +60,7 @@ func FilterResponseAsJson(provideValue func() T, change func(T) T) ResponseFilte
 			}
 
 			if body, err = json.Marshal(v); err != nil {
-				return nil, NewCriticalFailure(err, "JSON")
+				return nil, NewCriticalFailure(err, "JSON").WithStatus(http.StatusInternalServerError)
 			}
 
 			res := new(http.Response)
@@ -69,7 +71,7 @@ func FilterResponseAsJson(provideValue func() T, change func(T) T) ResponseFilte
 
 			return res, nil
 		} else {
-			return nil, NewCriticalFailure(err, "JSON")
+			return nil, NewCriticalFailure(err, "JSON").WithStatus(http.StatusBadGateway)
 		}
 	}
 }
@@ -1,8 +1,17 @@
 package connect
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -13,39 +22,179 @@ const (
 	LogLevel_NONE  int = iota
 )
 
-var (
-	level  = LogLevel_INFO
-	logger = log.New(os.Stdout, "", log.LstdFlags|log.Lmicroseconds)
-)
+var levelNames = map[int]string{
+	LogLevel_DEBUG: "debug",
+	LogLevel_INFO:  "info",
+	LogLevel_WARN:  "warn",
+	LogLevel_ERROR: "error",
+}
+
+// Fields are the structured details of a log entry, like the connection id, method, path or status.
+type Fields map[string]interface{}
+
+// Logger receives the log entries of a proxy, see SetLogger.
+type Logger interface {
+	Log(level int, message string, fields Fields)
+}
+
+// leveledLogger writes the entries at or above its level either as text lines or as JSON objects.
+type leveledLogger struct {
+	level int32
+	json  bool
+
+	lock sync.Mutex
+	out  io.Writer
+	text *log.Logger
+}
 
+var defaultLogger = NewTextLogger(os.Stdout, LogLevel_INFO).(*leveledLogger)
+
+// SetLogLevel sets the level of the default logger, used by proxies without their own logger.
 func SetLogLevel(newLevel int) {
-	level = newLevel
+	atomic.StoreInt32(&defaultLogger.level, int32(newLevel))
 }
 
-func (cp *connectionPair) debug(v ...interface{}) {
-	if level <= LogLevel_DEBUG {
-		cp.emitLog("[DEBUG]", v)
+// NewTextLogger returns a logger writing lines like the default one does, with the fields after the message.
+func NewTextLogger(w io.Writer, level int) Logger {
+	return &leveledLogger{
+		level: int32(level),
+		out:   w,
+		text:  log.New(w, "", log.LstdFlags|log.Lmicroseconds),
 	}
 }
 
-func (cp *connectionPair) info(v ...interface{}) {
-	if level <= LogLevel_INFO {
-		cp.emitLog("[INFO ]", v)
+// NewJsonLogger returns a logger writing a JSON object per line, with the time, level, message and fields.
+func NewJsonLogger(w io.Writer, level int) Logger {
+	return &leveledLogger{
+		level: int32(level),
+		json:  true,
+		out:   w,
 	}
 }
 
-func (cp *connectionPair) warn(v ...interface{}) {
-	if level <= LogLevel_WARN {
-		cp.emitLog("[WARN ]", v)
+func (l *leveledLogger) Log(level int, message string, fields Fields) {
+	if level < int(atomic.LoadInt32(&l.level)) {
+		return
 	}
+
+	if !l.json {
+		l.text.Println(formatText(level, message, fields))
+		return
+	}
+
+	entry := make(map[string]interface{}, len(fields)+3)
+	for key, value := range fields {
+		entry[key] = value
+	}
+	entry["time"] = time.Now().Format(time.RFC3339Nano)
+	entry["level"] = levelNames[level]
+	entry["msg"] = message
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line, _ = json.Marshal(map[string]interface{}{"level": levelNames[level], "msg": message, "error": err.Error()})
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.out.Write(append(line, '\n'))
+}
+
+// SetLogger sets the logger of the proxy, the default one is shared between
+// the proxies, writes text to the standard output, and its level is set by SetLogLevel.
+func (p *Proxy) SetLogger(logger Logger) {
+	p.logger = logger
+}
+
+func (p *Proxy) getLogger() Logger {
+	if p.logger != nil {
+		return p.logger
+	}
+
+	return defaultLogger
+}
+
+func formatText(level int, message string, fields Fields) string {
+	var parts []string
+
+	// the connection details go in front, like (proxy|listener|listener index|connection id)
+	if connection, ok := fields["connection"]; ok {
+		parts = append(parts, fmt.Sprintf("(%02d|%s|%02d|%04d)",
+			fields["proxy"], fields["listener"], fields["listener_index"], connection))
+	}
+
+	parts = append(parts, fmt.Sprintf("[%-5s]", strings.ToUpper(levelNames[level])), message)
+
+	var keys []string
+	for key := range fields {
+		switch key {
+		case "proxy", "listener", "listener_index", "connection":
+		default:
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%v", key, fields[key]))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func (cp *connectionPair) debug(v ...interface{}) {
+	cp.emitLog(LogLevel_DEBUG, nil, v)
+}
+
+func (cp *connectionPair) info(v ...interface{}) {
+	cp.emitLog(LogLevel_INFO, nil, v)
+}
+
+func (cp *connectionPair) warn(v ...interface{}) {
+	cp.emitLog(LogLevel_WARN, nil, v)
 }
 
 func (cp *connectionPair) error(v ...interface{}) {
-	if level <= LogLevel_ERROR {
-		cp.emitLog("[ERROR]", v)
+	cp.emitLog(LogLevel_ERROR, nil, v)
+}
+
+// logFields logs with structured fields, in addition to the ones of the connection.
+func (cp *connectionPair) logFields(level int, fields Fields, v ...interface{}) {
+	cp.emitLog(level, fields, v)
+}
+
+func (cp *connectionPair) emitLog(level int, extra Fields, v []interface{}) {
+	fields := Fields{
+		"proxy":          cp.proxy.idx,
+		"listener":       cp.localConn.logPrefix,
+		"listener_index": cp.localConn.idx,
+		"connection":     cp.connectionId,
+	}
+	for key, value := range extra {
+		fields[key] = value
+	}
+
+	cp.proxy.getLogger().Log(level, strings.TrimSuffix(fmt.Sprintln(v...), "\n"), fields)
+}
+
+func requestFields(request *http.Request, size int) Fields {
+	return Fields{
+		"request_id": ContextOf(request).RequestID,
+		"method":     request.Method,
+		"path":       request.URL.Path,
+		"bytes":      size,
 	}
 }
 
-func (cp *connectionPair) emitLog(prefix string, v []interface{}) {
-	logger.Println(append([]interface{}{cp.logPrefix, prefix}, v...)...)
+func responseFields(ex *exchange, response *http.Response, size int) Fields {
+	fields := requestFields(ex.request, size)
+	fields["status"] = response.StatusCode
+	fields["duration_ms"] = float64(time.Since(ex.started)) / float64(time.Millisecond)
+
+	if upstream := ContextOf(ex.request).Upstream; upstream != "" {
+		fields["upstream"] = upstream
+	}
+
+	return fields
 }
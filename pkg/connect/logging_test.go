@@ -0,0 +1,131 @@
+package connect
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type lockedBuffer struct {
+	lock   sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.buffer.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.buffer.String()
+}
+
+func TestPerProxyLoggers(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer server.Close()
+
+	startProxy := func(logger Logger) (*Proxy, string) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal("Failed to listen:", err)
+		}
+
+		proxy := NewProxy(func() (net.Conn, error) {
+			return net.Dial("tcp", server.Listener.Addr().String())
+		})
+		proxy.AddListener("", listener)
+		proxy.SetLogger(logger)
+
+		go proxy.Process(context.Background())
+
+		return proxy, "http://" + listener.Addr().String()
+	}
+
+	jsonOutput, textOutput := &lockedBuffer{}, &lockedBuffer{}
+
+	jsonProxy, jsonAddress := startProxy(NewJsonLogger(jsonOutput, LogLevel_DEBUG))
+	defer jsonProxy.closeAll()
+
+	textProxy, textAddress := startProxy(NewTextLogger(textOutput, LogLevel_WARN))
+	defer textProxy.closeAll()
+
+	jsonProxy.OnResponse("GET", "/fail", func(resp *http.Response, body []byte) (*http.Response, error) {
+		panic("unexpected")
+	})
+
+	for _, url := range []string{jsonAddress + "/info", jsonAddress + "/fail", textAddress + "/info"} {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal("Failed to send the request:", err)
+		}
+		resp.Body.Close()
+	}
+
+	// the response is logged after it is sent
+	deadline := time.Now().Add(time.Second)
+	for !strings.Contains(jsonOutput.String(), "HTTP 500") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var responses, stacks int
+
+	for _, line := range strings.Split(strings.TrimSpace(jsonOutput.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal("Unexpected log line:", line)
+		}
+
+		if entry["level"] == nil || entry["time"] == nil || entry["connection"] == nil || entry["proxy"] == nil {
+			t.Error("Missing fields in the log entry:", line)
+		}
+
+		if strings.HasPrefix(entry["msg"].(string), "Response: HTTP") {
+			responses++
+
+			if entry["method"] != "GET" || entry["status"] == nil || entry["duration_ms"] == nil || entry["bytes"] == nil {
+				t.Error("Missing response fields in the log entry:", line)
+			}
+			if entry["path"] == "/fail" && entry["status"] != float64(500) {
+				t.Error("Unexpected status for the failed response:", line)
+			}
+		}
+
+		if stack, ok := entry["stack"].(string); ok && strings.Contains(stack, "runResponseHandler") {
+			stacks++
+		}
+	}
+
+	if responses != 2 || stacks != 1 {
+		t.Errorf("Unexpected log entries (%d responses, %d stacks):\n%s", responses, stacks, jsonOutput)
+	}
+
+	if output := textOutput.String(); output != "" {
+		t.Error("Expected no output below the warning level:", output)
+	}
+}
+
+func TestTextLogFormat(t *testing.T) {
+	output := &lockedBuffer{}
+
+	NewTextLogger(output, LogLevel_INFO).Log(LogLevel_INFO, "Response: HTTP 200", Fields{
+		"proxy": 1, "listener": "unix", "listener_index": 2, "connection": 3, "status": 200, "method": "GET",
+	})
+
+	if line := output.String(); !strings.HasSuffix(line, " (01|unix|02|0003) [INFO ] Response: HTTP 200 method=GET status=200\n") {
+		t.Error("Unexpected log line:", line)
+	}
+}
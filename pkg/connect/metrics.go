@@ -0,0 +1,255 @@
+package connect
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var filterDurationBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// metrics are the counters and histograms of a proxy, exposed in the Prometheus text format.
+type metrics struct {
+	connectionsAccepted *metricFamily
+	requests            *metricFamily
+	filterExecutions    *metricFamily
+	filterDuration      *metricFamily
+	dialErrors          *metricFamily
+	bytes               *metricFamily
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		connectionsAccepted: newMetricFamily("docker_filter_connections_accepted_total", "counter",
+			"Client connections accepted, by listener.", "listener"),
+		requests: newMetricFamily("docker_filter_requests_total", "counter",
+			"Requests answered, by method, route (the Engine API operation, or other), "+
+				"upstream (default, a route name, or proxy when answered by the proxy) and status.",
+			"method", "route", "upstream", "status"),
+		filterExecutions: newMetricFamily("docker_filter_filter_executions_total", "counter",
+			"Filter executions, by kind (request, response, stream, frame) and outcome.", "kind", "outcome"),
+		filterDuration: newHistogramFamily("docker_filter_filter_duration_seconds",
+			"Time spent in filters, by kind.", filterDurationBuckets, "kind"),
+		dialErrors: newMetricFamily("docker_filter_upstream_dial_errors_total", "counter",
+			"Failed connection attempts to the upstreams, by route.", "route"),
+		bytes: newMetricFamily("docker_filter_upstream_bytes_total", "counter",
+			"Bytes sent to and received from the upstreams, upgraded streams included, by direction.", "direction"),
+	}
+}
+
+// WriteMetrics writes the metrics of the proxy in the Prometheus text format.
+func (p *Proxy) WriteMetrics(w io.Writer) error {
+	p.lock.Lock()
+	active := len(p.pairs)
+	p.lock.Unlock()
+
+	fmt.Fprintln(w, "# HELP docker_filter_connections_active Client connections being served.")
+	fmt.Fprintln(w, "# TYPE docker_filter_connections_active gauge")
+	fmt.Fprintln(w, "docker_filter_connections_active", active)
+
+	for _, family := range []*metricFamily{
+		p.metrics.connectionsAccepted,
+		p.metrics.requests,
+		p.metrics.filterExecutions,
+		p.metrics.filterDuration,
+		p.metrics.dialErrors,
+		p.metrics.bytes,
+	} {
+		if err := family.write(w); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MetricsHandler returns an HTTP handler responding with the metrics of the proxy.
+func (p *Proxy) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		p.WriteMetrics(w)
+	})
+}
+
+// ServeMetrics serves the metrics of the proxy on the listener, on any path, until the listener is closed.
+func (p *Proxy) ServeMetrics(listener net.Listener) error {
+	return http.Serve(listener, p.MetricsHandler())
+}
+
+func (m *metrics) filterExecuted(kind string, started time.Time, changed bool, err error) {
+	m.filterExecutions.add(1, kind, filterOutcome(changed, err))
+	m.filterDuration.observe(time.Since(started).Seconds(), kind)
+}
+
+func (m *metrics) requestAnswered(ex *exchange, response *http.Response) {
+	// unknown paths are not used as they are, to keep the number of series bounded
+	route, ok := knownOperation(ex.request)
+	if !ok {
+		route = "other"
+	}
+
+	upstream := "proxy"
+	if ex.upstream != nil {
+		upstream = routeLabel(ex.upstream.name)
+	}
+
+	m.requests.add(1, ex.request.Method, route, upstream, strconv.Itoa(response.StatusCode))
+}
+
+func routeLabel(name string) string {
+	if name == "" {
+		return "default"
+	}
+
+	return name
+}
+
+type metricFamily struct {
+	name    string
+	kind    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	lock   sync.Mutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labelValues []string
+
+	value  float64
+	counts []uint64
+	count  uint64
+}
+
+func newMetricFamily(name, kind, help string, labels ...string) *metricFamily {
+	return &metricFamily{
+		name:   name,
+		kind:   kind,
+		help:   help,
+		labels: labels,
+		series: map[string]*metricSeries{},
+	}
+}
+
+func newHistogramFamily(name, help string, buckets []float64, labels ...string) *metricFamily {
+	family := newMetricFamily(name, "histogram", help, labels...)
+	family.buckets = buckets
+	return family
+}
+
+func (f *metricFamily) get(labelValues []string) *metricSeries {
+	key := strings.Join(labelValues, "\xff")
+
+	series, ok := f.series[key]
+	if !ok {
+		series = &metricSeries{labelValues: labelValues, counts: make([]uint64, len(f.buckets))}
+		f.series[key] = series
+	}
+
+	return series
+}
+
+func (f *metricFamily) add(delta float64, labelValues ...string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.get(labelValues).value += delta
+}
+
+func (f *metricFamily) observe(value float64, labelValues ...string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	series := f.get(labelValues)
+	series.value += value
+	series.count++
+
+	for idx, bound := range f.buckets {
+		if value <= bound {
+			series.counts[idx]++
+		}
+	}
+}
+
+func (f *metricFamily) write(w io.Writer) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	lines := []string{
+		fmt.Sprintf("# HELP %s %s", f.name, f.help),
+		fmt.Sprintf("# TYPE %s %s", f.name, f.kind),
+	}
+
+	for _, key := range keys {
+		series := f.series[key]
+
+		if f.kind != "histogram" {
+			lines = append(lines, f.name+formatLabels(f.labels, series.labelValues)+" "+formatValue(series.value))
+			continue
+		}
+
+		labels := withLabel(f.labels, "le")
+		for idx, bound := range f.buckets {
+			lines = append(lines, f.name+"_bucket"+
+				formatLabels(labels, withLabel(series.labelValues, formatValue(bound)))+" "+strconv.FormatUint(series.counts[idx], 10))
+		}
+		lines = append(lines,
+			f.name+"_bucket"+formatLabels(labels, withLabel(series.labelValues, "+Inf"))+" "+strconv.FormatUint(series.count, 10),
+			f.name+"_sum"+formatLabels(f.labels, series.labelValues)+" "+formatValue(series.value),
+			f.name+"_count"+formatLabels(f.labels, series.labelValues)+" "+strconv.FormatUint(series.count, 10))
+	}
+
+	_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	return err
+}
+
+func withLabel(values []string, value string) []string {
+	return append(append(make([]string, 0, len(values)+1), values...), value)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for idx, name := range names {
+		pairs[idx] = name + `="` + labelValueEscaper.Replace(values[idx]) + `"`
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// countingReader counts the bytes read from the upstream.
+type countingReader struct {
+	io.Reader
+	metrics *metrics
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 {
+		r.metrics.bytes.add(float64(n), "received")
+	}
+	return n, err
+}
@@ -0,0 +1,108 @@
+package connect
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	SetLogLevel(LogLevel_ERROR)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer server.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen:", err)
+	}
+	defer listener.Close()
+
+	metricsListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen:", err)
+	}
+	defer metricsListener.Close()
+
+	proxy := NewProxy(func() (net.Conn, error) {
+		return net.Dial("tcp", server.Listener.Addr().String())
+	})
+	proxy.AddListener("", listener)
+
+	proxy.On("GET", "/secrets", func(req *http.Request, body []byte) (*http.Request, error) {
+		return nil, NewDenial(http.StatusForbidden, "no secrets")
+	})
+	proxy.OnResponse("GET", "/info", func(resp *http.Response, body []byte) (*http.Response, error) {
+		return NewResponse(http.StatusOK, "text/plain", []byte("changed")), nil
+	})
+	proxy.Route("offline", RouteByPath("GET", "/swarm"), func() (net.Conn, error) {
+		return nil, errors.New("not reachable")
+	})
+
+	go proxy.Process(context.Background())
+	go proxy.ServeMetrics(metricsListener)
+
+	for _, path := range []string{"/info", "/secrets", "/swarm", "/v1.37/unknown/path"} {
+		resp, err := http.Get("http://" + listener.Addr().String() + path)
+		if err != nil {
+			t.Fatal("Failed to send the request:", err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	var metrics string
+
+	// the requests are counted after their responses are sent
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		resp, err := http.Get("http://" + metricsListener.Addr().String() + "/metrics")
+		if err != nil {
+			t.Fatal("Failed to get the metrics:", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if metrics = string(body); strings.Contains(metrics, `route="other",upstream="default",status="200"} 1`) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, expected := range []string{
+		`docker_filter_connections_accepted_total{listener="tcp"} 1`,
+		`docker_filter_connections_active 1`,
+		`docker_filter_requests_total{method="GET",route="SystemInfo",upstream="default",status="200"} 1`,
+		`docker_filter_requests_total{method="GET",route="SecretList",upstream="proxy",status="403"} 1`,
+		`docker_filter_requests_total{method="GET",route="SwarmInspect",upstream="proxy",status="503"} 1`,
+		`docker_filter_requests_total{method="GET",route="other",upstream="default",status="200"} 1`,
+		`docker_filter_filter_executions_total{kind="request",outcome="denied"} 1`,
+		`docker_filter_filter_executions_total{kind="response",outcome="modified"} 1`,
+		`docker_filter_filter_duration_seconds_count{kind="request"} 1`,
+		`docker_filter_filter_duration_seconds_bucket{kind="response",le="+Inf"} 1`,
+		`docker_filter_upstream_dial_errors_total{route="offline"} 1`,
+		`# TYPE docker_filter_filter_duration_seconds histogram`,
+	} {
+		if !strings.Contains(metrics, expected) {
+			t.Error("Missing from the metrics:", expected)
+		}
+	}
+
+	for _, direction := range []string{"sent", "received"} {
+		if !strings.Contains(metrics, `docker_filter_upstream_bytes_total{direction="`+direction+`"} `) {
+			t.Error("Missing bytes", direction, "from the metrics")
+		}
+	}
+
+	if t.Failed() {
+		t.Log(metrics)
+	}
+}
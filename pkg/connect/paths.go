@@ -0,0 +1,95 @@
+package connect
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+type pathParamsKey struct{}
+
+var templateVariable = regexp.MustCompile(`\{([a-zA-Z_][a-zA-Z0-9_]*)(?::([^{}]+))?\}`)
+
+// On registers a request filter for the given HTTP method (or * for any) and path template,
+// like /containers/{id}/exec, where the optional API version prefix is ignored.
+// The values of the path parameters are available to the filter with PathParams.
+func (p *Proxy) On(method, pathTemplate string, filterFunc RequestFilterFunc) {
+	p.addHandler(&handler{
+		method:        method,
+		path:          pathTemplate,
+		pattern:       CompilePathTemplate(pathTemplate),
+		requestFilter: filterFunc,
+	})
+}
+
+// OnResponse registers a response filter the same way as On does for requests.
+func (p *Proxy) OnResponse(method, pathTemplate string, filterFunc ResponseFilterFunc) {
+	p.addHandler(&handler{
+		method:         method,
+		path:           pathTemplate,
+		pattern:        CompilePathTemplate(pathTemplate),
+		responseFilter: filterFunc,
+	})
+}
+
+// PathParams returns the path parameters bound by the handler the request is passed to.
+func PathParams(req *http.Request) map[string]string {
+	if req == nil {
+		return map[string]string{}
+	}
+
+	if params, ok := req.Context().Value(pathParamsKey{}).(map[string]string); ok {
+		return params
+	}
+
+	return map[string]string{}
+}
+
+// withPathParams binds the parameters of the matching handler, even when it has none,
+// so that the ones of an earlier handler are not visible to the later ones.
+func withPathParams(req *http.Request, params map[string]string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), pathParamsKey{}, params))
+}
+
+// CompilePathTemplate compiles a path template, like /containers/{id}/json or /images/{name:.+}/json,
+// to the expression the handlers registered with On match the request paths with, ignoring the
+// optional API version prefix. The parameters are named groups, matching [^/]+ unless given one.
+func CompilePathTemplate(template string) *regexp.Regexp {
+	pattern := "^(?:/v[0-9.]+)?"
+	last := 0
+
+	for _, m := range templateVariable.FindAllStringSubmatchIndex(template, -1) {
+		pattern += regexp.QuoteMeta(template[last:m[0]])
+
+		expression := "[^/]+"
+		if m[4] >= 0 {
+			expression = template[m[4]:m[5]]
+		}
+
+		pattern += "(?P<" + template[m[2]:m[3]] + ">" + expression + ")"
+		last = m[1]
+	}
+
+	return regexp.MustCompile(pattern + regexp.QuoteMeta(template[last:]) + "$")
+}
+
+func (h *handler) match(req *http.Request) (map[string]string, bool) {
+	if h.method != "" && h.method != "*" && !strings.EqualFold(h.method, req.Method) {
+		return nil, false
+	}
+
+	groups := h.pattern.FindStringSubmatch(req.URL.Path)
+	if groups == nil {
+		return nil, false
+	}
+
+	params := map[string]string{}
+	for idx, name := range h.pattern.SubexpNames() {
+		if name != "" {
+			params[name] = groups[idx]
+		}
+	}
+
+	return params, true
+}
@@ -0,0 +1,30 @@
+package connect
+
+import (
+	"net"
+	"syscall"
+)
+
+func peerCredentials(conn *net.UnixConn) *PeerCredentials {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil
+	}
+
+	var (
+		ucred    *syscall.Ucred
+		ucredErr error
+	)
+
+	if err := raw.Control(func(fd uintptr) {
+		ucred, ucredErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil || ucredErr != nil {
+		return nil
+	}
+
+	return &PeerCredentials{
+		Uid: int(ucred.Uid),
+		Gid: int(ucred.Gid),
+		Pid: int(ucred.Pid),
+	}
+}
@@ -0,0 +1,76 @@
+package connect
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnixPeerCredentials(t *testing.T) {
+	SetLogLevel(LogLevel_WARN)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "docker-filter")
+	if err != nil {
+		t.Fatal("Failed to create a temporary directory:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	listener, err := net.Listen("unix", filepath.Join(dir, "filtered.sock"))
+	if err != nil {
+		t.Fatal("Failed to listen:", err)
+	}
+	defer listener.Close()
+
+	proxy := NewProxy(func() (net.Conn, error) {
+		return net.Dial("tcp", server.Listener.Addr().String())
+	})
+	proxy.AddListener("unix", listener)
+
+	var requestClient, responseClient *ClientIdentity
+
+	proxy.On("GET", "/_ping", func(req *http.Request, body []byte) (*http.Request, error) {
+		requestClient = ClientOf(req)
+		return nil, nil
+	})
+	proxy.OnResponse("GET", "/_ping", func(resp *http.Response, body []byte) (*http.Response, error) {
+		responseClient = ClientOf(resp.Request)
+		return nil, nil
+	})
+
+	go proxy.Process(context.Background())
+
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", listener.Addr().String())
+		},
+	}}
+
+	resp, err := client.Get("http://docker/_ping")
+	if err != nil {
+		t.Fatal("Failed to send the request:", err)
+	}
+	resp.Body.Close()
+
+	if requestClient == nil || requestClient.Credentials == nil {
+		t.Fatal("Missing peer credentials:", requestClient)
+	}
+
+	credentials := requestClient.Credentials
+	if credentials.Uid != os.Getuid() || credentials.Gid != os.Getgid() || credentials.Pid != os.Getpid() {
+		t.Errorf("Unexpected peer credentials: %+v", credentials)
+	}
+
+	if responseClient != requestClient {
+		t.Error("Unexpected client identity for the response:", responseClient)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package connect
+
+import "net"
+
+func peerCredentials(conn *net.UnixConn) *PeerCredentials {
+	return nil // not supported on this platform
+}
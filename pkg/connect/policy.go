@@ -0,0 +1,590 @@
+package connect
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// policyDecisionKey is set in the context of the requests an allow or deny rule decided on, to the name of the rule.
+const policyDecisionKey = "policy.decision"
+
+// Policy is a declarative set of rules for the requests and responses passing through a proxy,
+// usually loaded from a JSON or YAML file with LoadPolicy, and compiled into filters with ApplyPolicy.
+//
+// The allow and deny rules decide on the requests they match, the first one matching wins,
+// and the requests no allow or deny rule matched get the default decision. The labels and defaults
+// rules change the JSON bodies of the requests they match, and the redact rules the JSON bodies
+// of the responses. The rules run in the order they are listed, after the filters registered earlier.
+type Policy struct {
+	// Default is the decision for the requests no allow or deny rule matched, allow (the default) or deny
+	Default string `json:"default"`
+	// DenyMessage is the message for the requests denied by default
+	DenyMessage string `json:"deny_message"`
+
+	Rules []*PolicyRule `json:"rules"`
+}
+
+// PolicyRule is a rule of a Policy, with an action for the requests or responses it matches.
+type PolicyRule struct {
+	// Name describes the rule in the errors and logs
+	Name  string      `json:"name"`
+	Match PolicyMatch `json:"match"`
+	// Action is one of allow, deny, labels, defaults or redact
+	Action string `json:"action"`
+
+	// Message and Status are sent to the clients the deny rules deny, 403 Forbidden by default
+	Message string `json:"message"`
+	Status  int    `json:"status"`
+	// Labels are added to the Labels of the request bodies by labels rules
+	Labels map[string]string `json:"labels"`
+	// Defaults are set by defaults rules on the fields (like HostConfig.Memory) missing from the request bodies
+	Defaults map[string]interface{} `json:"defaults"`
+	// Redact lists the fields (like Config.Env) redact rules hide the values of in the response bodies
+	Redact []string `json:"redact"`
+
+	pathPattern   *regexp.Regexp
+	fieldPatterns map[string]*regexp.Regexp
+}
+
+// PolicyMatch selects the requests a rule applies to, every condition given has to match.
+type PolicyMatch struct {
+	// Method is the HTTP method, any if empty
+	Method string `json:"method"`
+	// Path is a path template, like /containers/{id}/exec, and PathRegex a regular expression
+	// for the path, only one of them can be given, and any path matches if neither is
+	Path      string `json:"path"`
+	PathRegex string `json:"path_regex"`
+
+	// Fields are the values of fields (like HostConfig.Privileged) in the JSON request body, where
+	// null matches missing fields, and the lists match if one of their items is the value, the names
+	// of the fields match the keys differing in case too, as the daemon decodes them
+	Fields map[string]interface{} `json:"fields"`
+	// FieldsMatch are regular expressions for the values of the fields in the JSON request body
+	FieldsMatch map[string]string `json:"fields_match"`
+
+	Client *PolicyClient `json:"client"`
+}
+
+// PolicyClient matches the identity of the client, see ClientIdentity.
+type PolicyClient struct {
+	Uid        *int   `json:"uid"`
+	Gid        *int   `json:"gid"`
+	CommonName string `json:"common_name"`
+}
+
+// LoadPolicy reads and validates a policy from a JSON or YAML file.
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := ParsePolicy(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return policy, nil
+}
+
+// ParsePolicy parses and validates a policy in JSON or YAML, refusing unknown fields.
+func ParsePolicy(data []byte) (*Policy, error) {
+	if !json.Valid(data) {
+		converted, err := yamlToJson(data)
+		if err != nil {
+			return nil, err
+		}
+
+		data = converted
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	var policy Policy
+	if err := decoder.Decode(&policy); err != nil {
+		return nil, err
+	}
+
+	if err := policy.validate(); err != nil {
+		return nil, err
+	}
+
+	return &policy, nil
+}
+
+// yamlToJson converts a YAML document to JSON, to decode it with the same rules as the JSON policies.
+func yamlToJson(data []byte) ([]byte, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(jsonValue(v))
+}
+
+// jsonValue replaces the YAML mappings in a value with objects JSON can encode.
+func jsonValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[interface{}]interface{}:
+		fields := make(map[string]interface{}, len(value))
+		for key, field := range value {
+			fields[fmt.Sprint(key)] = jsonValue(field)
+		}
+		return fields
+
+	case []interface{}:
+		for idx, item := range value {
+			value[idx] = jsonValue(item)
+		}
+	}
+
+	return v
+}
+
+func (policy *Policy) validate() error {
+	switch policy.Default {
+	case "", "allow", "deny":
+	default:
+		return fmt.Errorf("invalid default decision: %q, expected allow or deny", policy.Default)
+	}
+
+	for idx, rule := range policy.Rules {
+		if rule == nil {
+			return fmt.Errorf("rule %d is empty", idx+1)
+		}
+
+		if err := rule.validate(); err != nil {
+			name := rule.Name
+			if name == "" {
+				name = "#" + fmt.Sprint(idx+1)
+			}
+
+			return fmt.Errorf("rule %s: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+func (rule *PolicyRule) validate() error {
+	switch rule.Action {
+	case "allow":
+	case "deny":
+		if rule.Status != 0 && (rule.Status < 400 || rule.Status > 599) {
+			return fmt.Errorf("invalid status for a denial: %d", rule.Status)
+		}
+	case "labels":
+		if len(rule.Labels) == 0 {
+			return fmt.Errorf("no labels to add")
+		}
+	case "defaults":
+		if len(rule.Defaults) == 0 {
+			return fmt.Errorf("no defaults to set")
+		}
+	case "redact":
+		if len(rule.Redact) == 0 {
+			return fmt.Errorf("no fields to redact")
+		}
+		if len(rule.Match.Fields) > 0 || len(rule.Match.FieldsMatch) > 0 {
+			return fmt.Errorf("redact rules can not match request fields")
+		}
+	default:
+		return fmt.Errorf("invalid action: %q, expected allow, deny, labels, defaults or redact", rule.Action)
+	}
+
+	match := rule.Match
+
+	switch {
+	case match.Path != "" && match.PathRegex != "":
+		return fmt.Errorf("only one of path and path_regex can be given")
+	case match.Path != "":
+		if !strings.HasPrefix(match.Path, "/") {
+			return fmt.Errorf("the path has to start with /: %s", match.Path)
+		}
+		rule.pathPattern = CompilePathTemplate(match.Path)
+	case match.PathRegex != "":
+		pattern, err := regexp.Compile(match.PathRegex)
+		if err != nil {
+			return fmt.Errorf("invalid path_regex: %s", err)
+		}
+		rule.pathPattern = pattern
+	}
+
+	rule.fieldPatterns = map[string]*regexp.Regexp{}
+	for field, expression := range match.FieldsMatch {
+		pattern, err := regexp.Compile(expression)
+		if err != nil {
+			return fmt.Errorf("invalid fields_match for %s: %s", field, err)
+		}
+		rule.fieldPatterns[field] = pattern
+	}
+
+	return nil
+}
+
+// ApplyPolicy registers the filters of the policy on the proxy.
+func (p *Proxy) ApplyPolicy(policy *Policy) {
+	for _, rule := range policy.Rules {
+		match := rule.Match
+
+		switch {
+		case rule.Action == "redact" && match.Path != "":
+			p.OnResponse(match.Method, match.Path, rule.responseFilter())
+		case rule.Action == "redact":
+			p.FilterResponses(match.PathRegex, rule.responseFilter())
+		case match.Path != "":
+			p.On(match.Method, match.Path, rule.requestFilter())
+		default:
+			p.FilterRequests(match.PathRegex, rule.requestFilter())
+		}
+	}
+
+	if policy.Default == "deny" {
+		message := policy.DenyMessage
+		if message == "" {
+			message = "Denied by the policy"
+		}
+
+		p.FilterRequests("", func(req *http.Request, body []byte) (*http.Request, error) {
+			if _, decided := ContextOf(req).Get(policyDecisionKey); decided {
+				return nil, nil
+			}
+
+			return nil, NewDenial(http.StatusForbidden, message)
+		})
+	}
+}
+
+func (rule *PolicyRule) requestFilter() RequestFilterFunc {
+	var change FilterFunc
+
+	switch rule.Action {
+	case "labels":
+		change = FilterAsJson(func() T { return new(interface{}) }, func(v T) T {
+			if fields, ok := (*v.(*interface{})).(map[string]interface{}); ok {
+				// merge the labels under keys differing in case too, the daemon would decode them over ours
+				labels := map[string]interface{}{}
+				for _, key := range fieldKeys(fields, "Labels") {
+					if existing, ok := fields[key].(map[string]interface{}); ok {
+						for name, value := range existing {
+							labels[name] = value
+						}
+					}
+
+					delete(fields, key)
+				}
+
+				for key, value := range rule.Labels {
+					labels[key] = value
+				}
+
+				fields["Labels"] = labels
+			}
+
+			return v
+		})
+
+	case "defaults":
+		change = FilterAsJson(func() T { return new(interface{}) }, func(v T) T {
+			if fields, ok := (*v.(*interface{})).(map[string]interface{}); ok {
+				for field, value := range rule.Defaults {
+					setDefault(fields, strings.Split(field, "."), value)
+				}
+			}
+
+			return v
+		})
+	}
+
+	return func(req *http.Request, body []byte) (*http.Request, error) {
+		rc := ContextOf(req)
+
+		if rule.Action == "allow" || rule.Action == "deny" {
+			if _, decided := rc.Get(policyDecisionKey); decided {
+				return nil, nil
+			}
+		}
+
+		if !rule.matches(req, body) {
+			return nil, nil
+		}
+
+		switch rule.Action {
+		case "allow":
+			rc.Set(policyDecisionKey, rule.Name)
+
+		case "deny":
+			rc.Set(policyDecisionKey, rule.Name)
+
+			status, message := rule.Status, rule.Message
+			if status == 0 {
+				status = http.StatusForbidden
+			}
+			if message == "" {
+				message = "Denied by the policy"
+			}
+
+			return nil, NewDenial(status, message)
+
+		default:
+			if !isJsonObject(body) {
+				return nil, nil // like the empty body of POST /images/create
+			}
+
+			return change(req, body)
+		}
+
+		return nil, nil
+	}
+}
+
+func (rule *PolicyRule) responseFilter() ResponseFilterFunc {
+	redact := FilterResponseAsJson(func() T { return new(interface{}) }, func(v T) T {
+		for _, field := range rule.Redact {
+			redactField(*v.(*interface{}), strings.Split(field, "."))
+		}
+
+		return v
+	})
+
+	return func(resp *http.Response, body []byte) (*http.Response, error) {
+		if !rule.matches(resp.Request, nil) || !json.Valid(body) {
+			return nil, nil
+		}
+
+		return redact(resp, body)
+	}
+}
+
+func (rule *PolicyRule) matches(req *http.Request, body []byte) bool {
+	match := rule.Match
+
+	if match.Method != "" && !strings.EqualFold(match.Method, req.Method) {
+		return false
+	}
+
+	if rule.pathPattern != nil && !rule.pathPattern.MatchString(req.URL.Path) {
+		return false
+	}
+
+	if client := match.Client; client != nil {
+		identity := ClientOf(req)
+
+		if client.CommonName != "" && client.CommonName != identity.CommonName {
+			return false
+		}
+
+		if client.Uid != nil || client.Gid != nil {
+			creds := identity.Credentials
+			if creds == nil || client.Uid != nil && *client.Uid != creds.Uid || client.Gid != nil && *client.Gid != creds.Gid {
+				return false
+			}
+		}
+	}
+
+	if len(match.Fields) == 0 && len(rule.fieldPatterns) == 0 {
+		return true
+	}
+
+	var v interface{}
+	json.Unmarshal(body, &v) // the fields of other bodies are all missing
+
+	for field, expected := range match.Fields {
+		if !fieldEquals(fieldValues(v, strings.Split(field, ".")), expected) {
+			return false
+		}
+	}
+
+	for field, pattern := range rule.fieldPatterns {
+		if !fieldMatches(fieldValues(v, strings.Split(field, ".")), pattern) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isJsonObject(body []byte) bool {
+	var fields map[string]interface{}
+	return json.Unmarshal(body, &fields) == nil && fields != nil
+}
+
+// fieldValues returns the values of a field in a JSON value, in each item of the lists on the way.
+func fieldValues(v interface{}, path []string) []interface{} {
+	if len(path) == 0 {
+		return []interface{}{v}
+	}
+
+	switch value := v.(type) {
+	case map[string]interface{}:
+		var values []interface{}
+		for _, key := range fieldKeys(value, path[0]) {
+			values = append(values, fieldValues(value[key], path[1:])...)
+		}
+		return values
+
+	case []interface{}:
+		var values []interface{}
+		for _, item := range value {
+			values = append(values, fieldValues(item, path)...)
+		}
+		return values
+	}
+
+	return nil
+}
+
+func fieldEquals(values []interface{}, expected interface{}) bool {
+	if expected == nil {
+		for _, value := range values {
+			if value != nil {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, value := range values {
+		if reflect.DeepEqual(value, expected) {
+			return true
+		}
+
+		if items, ok := value.([]interface{}); ok {
+			for _, item := range items {
+				if reflect.DeepEqual(item, expected) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+func fieldMatches(values []interface{}, pattern *regexp.Regexp) bool {
+	for _, value := range values {
+		items, ok := value.([]interface{})
+		if !ok {
+			items = []interface{}{value}
+		}
+
+		for _, item := range items {
+			switch item.(type) {
+			case nil, map[string]interface{}, []interface{}:
+				continue
+			}
+
+			if pattern.MatchString(fmt.Sprint(item)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// fieldKeys returns the keys of an object the daemon decodes a field from, which are, as encoding/json
+// matches them, the name of the field and the keys only differing from it in case.
+func fieldKeys(fields map[string]interface{}, name string) []string {
+	var keys []string
+	for key := range fields {
+		if strings.EqualFold(key, name) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+func setDefault(fields map[string]interface{}, path []string, value interface{}) {
+	keys := fieldKeys(fields, path[0])
+	if len(keys) == 0 {
+		keys = []string{path[0]}
+	}
+
+	for _, key := range keys {
+		if len(path) == 1 {
+			if fields[key] == nil {
+				fields[key] = value
+			}
+			continue
+		}
+
+		child, ok := fields[key].(map[string]interface{})
+		if !ok {
+			if fields[key] != nil {
+				continue // not an object, leave it as it is
+			}
+
+			child = map[string]interface{}{}
+			fields[key] = child
+		}
+
+		setDefault(child, path[1:], value)
+	}
+}
+
+func redactField(v interface{}, path []string) {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for _, key := range fieldKeys(value, path[0]) {
+			field := value[key]
+			if field == nil {
+				continue
+			}
+
+			if len(path) == 1 {
+				value[key] = redactedValue(field)
+			} else {
+				redactField(field, path[1:])
+			}
+		}
+
+	case []interface{}:
+		for _, item := range value {
+			redactField(item, path)
+		}
+	}
+}
+
+// redactedValue keeps the type of the value, so that clients can still decode it,
+// with *** for the strings, and KEY=*** for the KEY=value items of lists like Env.
+func redactedValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case string:
+		return "***"
+
+	case []interface{}:
+		redacted := make([]interface{}, len(value))
+		for idx, item := range value {
+			if text, ok := item.(string); ok && strings.Contains(text, "=") {
+				redacted[idx] = text[:strings.Index(text, "=")] + "=***"
+			} else {
+				redacted[idx] = redactedValue(item)
+			}
+		}
+		return redacted
+
+	case map[string]interface{}:
+		for key, field := range value {
+			value[key] = redactedValue(field)
+		}
+		return value
+
+	case float64:
+		return 0
+
+	case bool:
+		return false
+	}
+
+	return v
+}
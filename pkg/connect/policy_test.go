@@ -0,0 +1,269 @@
+package connect_test
+
+import (
+	"context"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/rycus86/docker-filter/pkg/connect"
+	"github.com/rycus86/docker-filter/pkg/connect/connecttest"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const testPolicy = `{
+	"default": "deny",
+	"deny_message": "Not in the policy",
+	"rules": [
+		{"name": "ping", "match": {"path": "/_ping"}, "action": "allow"},
+		{
+			"name": "no-privileged",
+			"match": {"method": "POST", "path": "/containers/create", "fields": {"HostConfig.Privileged": true}},
+			"action": "deny",
+			"message": "Privileged containers are not allowed"
+		},
+		{
+			"name": "trusted-images",
+			"match": {"method": "POST", "path": "/containers/create", "fields_match": {"Image": "^(alpine|busybox)(:|$)"}},
+			"action": "allow"
+		},
+		{"name": "owner", "match": {"method": "POST", "path": "/containers/create"}, "action": "labels", "labels": {"owner": "ci"}},
+		{
+			"name": "memory",
+			"match": {"method": "POST", "path": "/containers/create"},
+			"action": "defaults",
+			"defaults": {"HostConfig.Memory": 268435456}
+		},
+		{"name": "list", "match": {"method": "GET", "path_regex": "/containers/json$"}, "action": "allow"},
+		{"name": "hide-env", "match": {"path": "/containers/json"}, "action": "redact", "redact": ["Config.Env"]}
+	]
+}`
+
+func TestPolicy(t *testing.T) {
+	env := connecttest.New(t)
+
+	env.Daemon.Handle("GET", "/containers/json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"Id":"c1","Config":{"Env":["TOKEN=secret"]}},{"Id":"c2","Config":{}}]`))
+	})
+	env.Daemon.Handle("POST", "/containers/create", func(w http.ResponseWriter, r *http.Request) {
+		// answer with the request the daemon received
+		w.Header().Set("Content-Type", "application/json")
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	})
+
+	policy, err := connect.ParsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatal("Failed to parse the policy:", err)
+	}
+	env.Proxy.ApplyPolicy(policy)
+	env.Start()
+
+	address := strings.Replace(env.Address(), "tcp://", "http://", 1)
+
+	for _, tc := range []struct {
+		method, path, body string
+		status             int
+		response           []string
+	}{
+		{"GET", "/_ping", "", http.StatusOK, nil},
+		{"POST", "/v1.37/containers/create", `{"Image":"alpine","HostConfig":{"Privileged":true}}`,
+			http.StatusForbidden, []string{"Privileged containers are not allowed"}},
+		{"POST", "/v1.37/containers/create", `{"Image":"alpine","hostconfig":{"privileged":true}}`,
+			http.StatusForbidden, []string{"Privileged containers are not allowed"}},
+		{"POST", "/v1.37/containers/create", `{"Image":"alpine:3.8","HostConfig":{"Memory":1024}}`,
+			http.StatusOK, []string{`"Labels":{"owner":"ci"}`, `"Memory":1024`}},
+		{"POST", "/containers/create", `{"Image":"busybox"}`,
+			http.StatusOK, []string{`"Labels":{"owner":"ci"}`, `"HostConfig":{"Memory":268435456}`}},
+		{"POST", "/containers/create", `{"Image":"busybox","labels":{"owner":"someone","team":"a"},"hostConfig":{"Memory":1}}`,
+			http.StatusOK, []string{`{"Image":"busybox","Labels":{"owner":"ci","team":"a"},"hostConfig":{"Memory":1}}`}},
+		{"POST", "/containers/create", `{"Image":"ubuntu"}`, http.StatusForbidden, []string{"Not in the policy"}},
+		{"GET", "/containers/json", "", http.StatusOK, []string{`"Env":["TOKEN=***"]`, `{"Config":{},"Id":"c2"}`}},
+		{"GET", "/info", "", http.StatusForbidden, []string{"Not in the policy"}},
+	} {
+		req, _ := http.NewRequest(tc.method, address+tc.path, strings.NewReader(tc.body))
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("Failed to send the request:", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != tc.status {
+			t.Errorf("Unexpected status for %s %s %s: %d %s", tc.method, tc.path, tc.body, resp.StatusCode, body)
+		}
+
+		for _, expected := range tc.response {
+			if !strings.Contains(string(body), expected) {
+				t.Errorf("Unexpected response for %s %s %s: %s", tc.method, tc.path, tc.body, body)
+			}
+		}
+	}
+
+	env.Daemon.AssertNotReceived(t, "GET", "/info")
+}
+
+func TestPolicyChangesOnlyJsonObjects(t *testing.T) {
+	env := connecttest.New(t)
+
+	env.Daemon.Handle("POST", "/{kind}/create", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	policy, err := connect.ParsePolicy([]byte(`{"rules": [
+		{"name": "owner", "match": {"method": "POST", "path_regex": "/create$"}, "action": "labels", "labels": {"owner": "ci"}},
+		{"name": "memory", "match": {"method": "POST", "path_regex": "/create$"}, "action": "defaults", "defaults": {"HostConfig.Memory": 1}}
+	]}`))
+	if err != nil {
+		t.Fatal("Failed to parse the policy:", err)
+	}
+	env.Proxy.ApplyPolicy(policy)
+	env.Start()
+
+	address := strings.Replace(env.Address(), "tcp://", "http://", 1)
+
+	for path, body := range map[string]string{
+		"/images/create?fromImage=alpine": "",
+		"/volumes/create":                 "not json",
+		"/networks/create":                "[]",
+	} {
+		resp, err := http.Post(address+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal("Failed to send the request:", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Unexpected status for %s: %d", path, resp.StatusCode)
+		}
+
+		if received := env.Daemon.AssertReceived(t, "POST", strings.Split(path, "?")[0]); string(received.Body) != body {
+			t.Errorf("Unexpected body for %s: %s", path, received.Body)
+		}
+	}
+}
+
+func TestPolicyWithAggregatedLists(t *testing.T) {
+	env := connecttest.New(t)
+
+	env.Daemon.Handle("GET", "/images/json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"Id":"sha256:1234"}]`))
+	})
+
+	// the lists are fetched after the request filters, even the ones registered later
+	upstream := connect.NewUpstream("local", env.Daemon.Dial)
+	for _, path := range []string{"/containers/json", "/images/json", "/volumes"} {
+		env.Proxy.Aggregate(path, upstream)
+	}
+
+	policy, err := connect.ParsePolicy([]byte(`{
+		"default": "deny",
+		"rules": [
+			{"name": "containers", "match": {"path": "/containers/json"}, "action": "deny", "message": "Listing containers is not allowed"},
+			{"name": "images", "match": {"method": "GET", "path": "/images/json"}, "action": "allow"}
+		]
+	}`))
+	if err != nil {
+		t.Fatal("Failed to parse the policy:", err)
+	}
+	env.Proxy.ApplyPolicy(policy)
+
+	env.Proxy.On("GET", "/images/json", func(req *http.Request, body []byte) (*http.Request, error) {
+		// scope the lists to the images of the tenant
+		query := req.URL.Query()
+		query.Set("filters", `{"label":{"tenant=a":true}}`)
+		req.URL.RawQuery = query.Encode()
+		return req, nil
+	})
+	env.Start()
+
+	if _, err := env.Client.ContainerList(context.Background(), types.ContainerListOptions{}); err == nil ||
+		!strings.Contains(err.Error(), "Listing containers is not allowed") {
+
+		t.Error("Unexpected error for the denied list:", err)
+	}
+
+	if _, err := env.Client.VolumeList(context.Background(), filters.Args{}); err == nil ||
+		!strings.Contains(err.Error(), "Denied by the policy") {
+
+		t.Error("Unexpected error for the list denied by default:", err)
+	}
+
+	if images, err := env.Client.ImageList(context.Background(), types.ImageListOptions{}); err != nil {
+		t.Error("Failed to list the images:", err)
+	} else if len(images) != 1 || images[0].Labels[connect.SourceLabel] != "local" {
+		t.Errorf("Unexpected images: %+v", images)
+	}
+
+	if received := env.Daemon.AssertReceived(t, "GET", "/images/json"); !strings.Contains(received.Query, "tenant%3Da") {
+		t.Error("Unexpected query for the aggregated list:", received.Query)
+	}
+
+	env.Daemon.AssertNotReceived(t, "GET", "/containers/json")
+	env.Daemon.AssertNotReceived(t, "GET", "/volumes")
+}
+
+func TestYamlPolicy(t *testing.T) {
+	policy, err := connect.ParsePolicy([]byte(`
+default: deny
+rules:
+  - name: no-privileged
+    match:
+      method: POST
+      path: /containers/create
+      fields:
+        HostConfig.Privileged: true
+    action: deny
+    status: 400
+  - name: owner
+    match: {path: /containers/create}
+    action: labels
+    labels: {owner: ci}
+`))
+	if err != nil {
+		t.Fatal("Failed to parse the policy:", err)
+	}
+
+	if policy.Default != "deny" || len(policy.Rules) != 2 {
+		t.Fatalf("Unexpected policy: %+v", policy)
+	}
+
+	if deny := policy.Rules[0]; deny.Status != 400 || deny.Match.Fields["HostConfig.Privileged"] != true || deny.Match.Path != "/containers/create" {
+		t.Errorf("Unexpected rule: %+v", deny)
+	}
+
+	if labels := policy.Rules[1]; labels.Labels["owner"] != "ci" {
+		t.Errorf("Unexpected rule: %+v", labels)
+	}
+
+	for policy, expected := range map[string]string{
+		"rules:\n  - action: allow\n    unknown: 1\n": "unknown field",
+		"rules:\n  - action: [allow\n":                "yaml:",
+	} {
+		if _, err := connect.ParsePolicy([]byte(policy)); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Unexpected error for %s: %v", policy, err)
+		}
+	}
+}
+
+func TestInvalidPolicies(t *testing.T) {
+	for policy, expected := range map[string]string{
+		`{"default": "maybe"}`:                                                                           "invalid default decision",
+		`{"rules": [{"action": "allow", "unknown": 1}]}`:                                                 "unknown field",
+		`{"rules": [{"name": "x", "action": "permit"}]}`:                                                 "rule x: invalid action",
+		`{"rules": [{"action": "labels"}]}`:                                                              "rule #1: no labels to add",
+		`{"rules": [{"action": "deny", "status": 200}]}`:                                                 "invalid status",
+		`{"rules": [{"action": "allow", "match": {"path": "info"}}]}`:                                    "has to start with /",
+		`{"rules": [{"action": "allow", "match": {"path": "/a", "path_regex": "/b"}}]}`:                  "only one of path and path_regex",
+		`{"rules": [{"action": "allow", "match": {"fields_match": {"Image": "("}}}]}`:                    "invalid fields_match for Image",
+		`{"rules": [{"action": "redact", "redact": ["Env"], "match": {"fields": {"Image": "alpine"}}}]}`: "can not match request fields",
+	} {
+		if _, err := connect.ParsePolicy([]byte(policy)); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Unexpected error for %s: %v", policy, err)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package connect
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -12,11 +13,13 @@ import (
 	"regexp"
 	"runtime/debug"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 var (
-	proxyIndex = 0
-	connIndex  = 0
+	proxyIndex       = 0
+	connIndex  int64 = 0
 )
 
 func NewProxy(remote func() (net.Conn, error), nonManagedResponses ...string) *Proxy {
@@ -30,6 +33,10 @@ func NewProxy(remote func() (net.Conn, error), nonManagedResponses ...string) *P
 		idx: proxyIndex,
 
 		nonManagedResponses: nonManagedResponses,
+
+		pairs: map[*connectionPair]struct{}{},
+
+		metrics: newMetrics(),
 	}
 }
 
@@ -49,63 +56,118 @@ func (p *Proxy) Handle(urlPattern string, filterFunc FilterFunc) {
 }
 
 func (p *Proxy) FilterRequests(urlPattern string, filterFunc RequestFilterFunc) {
-	p.handlers = append(p.handlers, &handler{
+	p.addHandler(&handler{
+		path:          urlPattern,
 		pattern:       regexp.MustCompile(urlPattern),
 		requestFilter: filterFunc,
 	})
 }
 
 func (p *Proxy) FilterResponses(urlPattern string, filterFunc ResponseFilterFunc) {
-	p.handlers = append(p.handlers, &handler{
+	p.addHandler(&handler{
+		path:           urlPattern,
 		pattern:        regexp.MustCompile(urlPattern),
 		responseFilter: filterFunc,
 	})
 }
 
-func (p *Proxy) Process() error {
+// SetMaxRequestBodySize limits the size of the request bodies read into memory for the filters,
+// larger ones are answered with 413 Request Entity Too Large, and their connection is closed.
+// Zero, the default, means no limit. The bodies of the requests no request filter matches,
+// like build contexts or image tarballs usually, are streamed to the upstream without a limit.
+func (p *Proxy) SetMaxRequestBodySize(size int64) {
+	p.maxRequestBodySize = size
+}
+
+func (p *Proxy) Process(ctx context.Context) error {
 	if len(p.listeners) == 0 {
 		return errors.New("no local listeners are registered")
 	}
 
-	acceptChan := p.startPolling()
+	stop := make(chan struct{})
+	defer close(stop)
 
-	for {
-		polled := <-acceptChan
+	acceptChan := p.startPolling(stop)
 
-		if polled.err != nil {
+	for {
+		select {
+		case <-ctx.Done():
 			p.closeAll()
-			return polled.err
-		}
+			return ctx.Err()
 
-		if pair, err := polled.conn.connectToRemote(p); err != nil {
-			polled.conn.writeFailedResponse("failed to connect to the remote", err)
-			continue
+		case polled := <-acceptChan:
+			if polled.err != nil {
+				p.closeAll()
 
-		} else {
-			go pair.handleRequests()
-			go pair.handleResponses()
+				if p.isShuttingDown() {
+					return ErrProxyClosed
+				}
+				return polled.err
+			}
+
+			if p.isShuttingDown() {
+				polled.conn.Close()
+				continue
+			}
 
+			p.metrics.connectionsAccepted.add(1, polled.conn.logPrefix)
+
+			go p.serve(polled.conn)
 		}
 	}
 }
 
-func (p *Proxy) startPolling() chan *pollResult {
+func (p *Proxy) serve(lc *localConnection) {
+	client, err := identifyClient(lc.Conn)
+	if err != nil {
+		lc.Close()
+		return
+	}
+	lc.client = client
+
+	// the upstreams are connected to when the first request is sent to them
+	pair := lc.newConnectionPair(p)
+	if !p.track(pair) {
+		pair.close("shutdown", ErrProxyClosed)
+		return
+	}
+
+	go pair.handleRequests()
+	go pair.handleResponses()
+}
+
+func (p *Proxy) startPolling(stop chan struct{}) chan *pollResult {
 	acceptChan := make(chan *pollResult, 1)
 	listenLoop := func(listener *localListener, num int) {
 		for {
+			var result *pollResult
+
 			conn, err := listener.Accept()
 			if err != nil {
-				break
+				result = &pollResult{err: err}
+			} else {
+				result = &pollResult{
+					conn: &localConnection{
+						Conn:      conn,
+						proxy:     p,
+						idx:       num,
+						logPrefix: listener.logPrefix,
+					},
+					err: nil,
+				}
 			}
 
-			acceptChan <- &pollResult{
-				conn: &localConnection{
-					Conn:      conn,
-					proxy:     p,
-					idx:       num,
-					logPrefix: listener.logPrefix,
-				},
-				err: nil,
+			select {
+			case acceptChan <- result:
+			case <-stop:
+				if result.conn != nil {
+					result.conn.Close()
+				}
+				return
+			}
+
+			if err != nil {
+				return
 			}
 		}
 	}
@@ -123,127 +185,277 @@ func (p *Proxy) closeAll() {
 	}
 }
 
-func (lc *localConnection) nextLogPrefix() string {
-	connIndex += 1
-
-	return fmt.Sprintf("(%02d|%s|%02d|%04d)",
-		lc.proxy.idx, lc.logPrefix, lc.idx, connIndex)
+func (lc *localConnection) nextConnectionId() int {
+	return int(atomic.AddInt64(&connIndex, 1))
 }
 
-func (lc *localConnection) connectToRemote(p *Proxy) (*connectionPair, error) {
-	remoteConn, err := p.dialer()
-	if err != nil {
-		lc.writeFailedResponse("Failed to connect the proxy to the remote", err)
-		lc.Close()
-		return nil, err
-	}
+func (lc *localConnection) newConnectionPair(p *Proxy) *connectionPair {
+	connectionId := lc.nextConnectionId()
 
 	return &connectionPair{
-		localConn:  lc,
-		remoteConn: remoteConn,
-		proxy:      p,
+		localConn: lc,
+		remotes:   map[*route]*upstreamConn{},
+		proxy:     p,
 
-		logPrefix: lc.nextLogPrefix(),
-	}, nil
-}
+		connectionId: connectionId,
 
-func (lc *localConnection) writeFailedResponse(reason string, err error) error {
-	message := fmt.Sprintf("{\"message\":\"%s: %s\"}", reason, err.Error())
-	response := &http.Response{
-		StatusCode:    503,
-		ProtoMajor:    1,
-		ProtoMinor:    1,
-		Close:         true,
-		ContentLength: int64(len(message)),
-		Header:        http.Header{"Content-Type": {"application/json"}},
-		Body:          ioutil.NopCloser(strings.NewReader(message)),
+		pending: make(chan *exchange, 32),
+		done:    make(chan struct{}),
 	}
-
-	return response.Write(lc)
 }
 
 func (cp *connectionPair) handleRequests() {
-	buffer := make([]byte, 16000)
+	reader := bufio.NewReader(cp.localConn)
 
-	cp.upgraded = false
+	defer close(cp.pending)
 
 	for {
-		n, err := cp.localConn.Read(buffer)
+		request, err := http.ReadRequest(reader)
 		if err != nil {
-			if cp.upgraded && err == io.EOF {
-				cp.closeReading()
+			cp.close("request", err)
+			return
+		}
+		started := time.Now()
+
+		handlers := cp.proxy.currentHandlers()
+		buffered := readsRequestBody(handlers, request)
+
+		limit := cp.proxy.maxRequestBodySize
+
+		var body []byte
+		if buffered {
+			var source io.Reader = request.Body
+			if limit > 0 {
+				source = io.LimitReader(request.Body, limit+1)
+			}
+
+			body, err = ioutil.ReadAll(source)
+			if err != nil {
+				cp.close("request", err)
 				return
 			}
+		}
+
+		request = withRequestContext(request, cp.newRequestContext())
 
+		if !cp.beginExchange() {
+			return
+		}
+
+		if buffered && limit > 0 && int64(len(body)) > limit {
+			// the rest of the body is still on the connection, so it is closed after the response
+			cp.warn("Request body on", request.URL, "is larger than", limit, "bytes")
+
+			request.Body = http.NoBody
+			cp.enqueue(&exchange{
+				request:    request,
+				response:   NewDenial(http.StatusRequestEntityTooLarge, fmt.Sprintf("The request body is larger than %d bytes", limit)).toResponse(),
+				started:    started,
+				closeAfter: true,
+			})
+			return
+		}
+
+		var received *RecordedRequest
+		if cp.proxy.recorder != nil {
+			received = recordRequest(request, body)
+		}
+
+		var ex *exchange
+		if buffered {
+			request.Body.Close()
+			ex = cp.filterRequest(handlers, request, body)
+		} else {
+			// no request filter matches, so the body is sent to the upstream as it is read
+			ex = &exchange{handlers: handlers, request: request}
+		}
+		ex.started, ex.received = started, received
+
+		// the body not sent to the upstream is still on the connection, so it is closed after the response
+		unread := !buffered && request.Body != http.NoBody
+
+		request, body = ex.request, ex.requestBody
+
+		if ex.response != nil {
+			if !cp.enqueue(ex) {
+				return
+			}
+			cp.logFields(LogLevel_INFO, requestFields(request, len(body)), "Responding to", request.URL, "without the remote")
+
+			if ex.closeAfter {
+				return
+			}
+			continue
+		}
+
+		if list := cp.proxy.aggregateFor(request); list != nil {
+			ex.response, ex.aggregated, ex.closeAfter = cp.fetchAggregated(list, request), true, unread
+			if !cp.enqueue(ex) {
+				return
+			}
+			cp.logFields(LogLevel_INFO, requestFields(request, len(body)), "Responding to", request.URL, "with the aggregated lists")
+
+			if ex.closeAfter {
+				return
+			}
+			continue
+		}
+
+		upstream, err := cp.upstreamFor(request)
+		if err != nil {
+			cp.warn("Failed to connect to the upstream for", request.URL, ":", err)
+
+			failure := NewDenial(http.StatusServiceUnavailable, "Failed to connect the proxy to the remote: "+err.Error())
+			ex.response, ex.closeAfter = failure.toResponse(), unread
+			if !cp.enqueue(ex) || ex.closeAfter {
+				return
+			}
+			continue
+		}
+
+		ContextOf(request).Upstream = upstream.name
+
+		ex.upstream = upstream
+		if isUpgradeRequest(request) {
+			ex.switched = make(chan bool, 1)
+		}
+		if !cp.enqueue(ex) {
+			return
+		}
+
+		if err := request.Write(upstream); err != nil {
 			cp.close("request", err)
 			return
 		}
+		cp.logFields(LogLevel_INFO, requestFields(request, len(body)), "Sent HTTP request to", request.URL, ":", len(body), "bytes")
+
+		if ex.switched != nil {
+			// wait for the upstream to accept the upgrade, otherwise the next requests are not raw data
+			select {
+			case switched := <-ex.switched:
+				if !switched {
+					continue
+				}
+			case <-cp.done:
+				return
+			}
 
-		if n > 0 {
-			data := buffer[0:n]
-			request, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+			cp.markUpgraded()
+
+			// the rest of the connection is a raw stream
+			n, err := io.Copy(upstream, cp.filterInputFrames(reader, ex))
+			cp.debug("Sent raw stream data:", n, "bytes")
 
 			if err != nil {
-				cp.remoteConn.Write(data)
-				cp.debug("Sent request data:", n, "bytes (failed to parse request)")
-			} else if body, err := ioutil.ReadAll(request.Body); err != nil {
-				cp.remoteConn.Write(data)
-				cp.debug("Sent request data:", n, "bytes (failed to read request body)")
+				cp.close("request", err)
 			} else {
-				if request.Header.Get("Upgrade") == "tcp" {
-					cp.upgraded = true
-				}
+				cp.closeReading(upstream)
+			}
+			return
+		}
+	}
+}
 
-				for _, handler := range cp.proxy.handlers {
-					if handler.requestFilter == nil {
-						continue
-					}
+// enqueue passes the exchange on to the responses, unless the connections are closed,
+// in which case nothing reads the queue anymore.
+func (cp *connectionPair) enqueue(ex *exchange) bool {
+	select {
+	case cp.pending <- ex:
+		return true
+	case <-cp.done:
+		return false
+	}
+}
 
-					if !handler.pattern.MatchString(request.URL.Path) {
-						continue
-					}
+// readsRequestBody tells whether the body of the request is read into memory, which is only needed for
+// the request filters matching it, and for the frame filters of exec sessions, to tell whether they use a TTY.
+func readsRequestBody(handlers []*handler, request *http.Request) bool {
+	if len(frameFiltersFor(handlers, request)) > 0 {
+		return true
+	}
 
-					if changedRequest, err := runRequestHandler(handler, request, body); err != nil {
-						if _, ok := err.(CriticalFailure); ok {
-							cp.error("Critical:", "Failed to execute request filter on", request.URL, ":", err)
+	for _, handler := range handlers {
+		if handler.requestFilter == nil {
+			continue
+		}
 
-							cp.localConn.writeFailedResponse("Failed to apply filter", err)
-							cp.close("request", err)
-							return
+		if _, ok := handler.match(request); ok {
+			return true
+		}
+	}
 
-						} else {
-							cp.warn("Request filter warning on", request.URL, ":", err)
-						}
+	return false
+}
 
-					} else if changedRequest != nil {
-						request = changedRequest
-						body, _ = ioutil.ReadAll(changedRequest.Body)
-						changedRequest.Body.Close()
+// filterRequest runs the request filters, and returns the exchange with the request to send
+// to the upstream, or with the response to send to the client instead.
+func (cp *connectionPair) filterRequest(handlers []*handler, request *http.Request, body []byte) *exchange {
+	ex := &exchange{handlers: handlers}
 
-					}
-				}
+	for _, handler := range ex.handlers {
+		if handler.requestFilter == nil {
+			continue
+		}
 
-				if len(body) > 0 {
-					request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		params, ok := handler.match(request)
+		if !ok {
+			continue
+		}
+
+		changedRequest, err := cp.runRequestHandler(handler, withPathParams(request, params), body)
+		ex.decisions = append(ex.decisions, handler.decision("request", changedRequest != nil, err))
+
+		if err != nil {
+			if direct, ok := err.(DirectResponse); ok {
+				ex.response = direct.Response
+				break
+
+			} else if denial, ok := asDenial(err); ok {
+				if _, critical := err.(CriticalFailure); critical {
+					cp.error("Critical:", "Failed to execute request filter on", request.URL, ":", err)
+					ex.closeAfter = true
+				} else {
+					cp.warn("Request denied on", request.URL, ":", err)
 				}
 
-				cp.latestRequest = request
+				ex.response = denial.toResponse()
+				break
+
+			} else {
+				cp.warn("Request filter warning on", request.URL, ":", err)
+			}
 
-				request.Write(cp.remoteConn)
-				cp.info("Sent HTTP request to", request.URL, ":", len(body), "bytes")
+		} else if changedRequest != nil {
+			if changedRequest.Context() == context.Background() {
+				// keep the details the proxy attached to the original request
+				changedRequest = changedRequest.WithContext(request.Context())
 			}
+
+			request = changedRequest
+			body, _ = ioutil.ReadAll(changedRequest.Body)
+			changedRequest.Body.Close()
+
 		}
 	}
+
+	request.Body, request.ContentLength, request.TransferEncoding = bufferedBody(body)
+
+	ex.request, ex.requestBody = request, body
+	return ex
 }
 
-func runRequestHandler(handler *handler, request *http.Request, body []byte) (changed *http.Request, err error) {
+func (cp *connectionPair) runRequestHandler(handler *handler, request *http.Request, body []byte) (changed *http.Request, err error) {
+	started := time.Now()
+	defer func() { cp.proxy.metrics.filterExecuted("request", started, changed != nil, err) }()
+
 	defer func() {
 		if r := recover(); r != nil {
 			switch r.(type) {
-			case SoftFailure, CriticalFailure:
+			case SoftFailure, CriticalFailure, Denial, DirectResponse:
 				err = r.(error)
 			default:
-				err = NewCriticalFailure(r, "RequestFilter")
+				cp.logFields(LogLevel_DEBUG, Fields{"stack": string(debug.Stack())}, "Request filter panicked:", r)
+				err = NewCriticalFailure(r, "RequestFilter").WithStatus(http.StatusInternalServerError)
 			}
 		}
 	}()
@@ -252,97 +464,177 @@ func runRequestHandler(handler *handler, request *http.Request, body []byte) (ch
 }
 
 func (cp *connectionPair) handleResponses() {
-	buffer := make([]byte, 16000)
-	reader := &responseReader{r: cp.remoteConn}
+	for ex := range cp.pending {
+		request := ex.request
+
+		response, err := ex.response, error(nil)
+		if response != nil {
+			prepareDirectResponse(response, request)
+		} else if response, err = cp.readResponse(ex.upstream.reader, request); err != nil {
+			cp.audit(ex, nil, nil, err)
+			cp.close("response", err)
+			return
+		} else {
+			ex.upstreamStatus = response.StatusCode
 
-	for {
-		n, err := reader.Read(buffer)
-		if err != nil {
+			if response.Close && !isUpgradeRequest(request) {
+				// the upstream closes its side, the next request connects to it again
+				ex.upstream.markClosed()
+
+				if !request.Close {
+					response.Close = false
+					response.Header.Del("Connection")
+				}
+			}
+		}
+
+		var body []byte
+
+		if cp.allowReadingResponseBody(ex, response) {
+			body, err = ioutil.ReadAll(response.Body)
+			if err != nil {
+				cp.close("response", err)
+				return
+			}
+			response.Body.Close()
+
+			response.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		if cp.proxy.recorder != nil && (ex.upstream != nil || ex.aggregated) {
+			ex.upstreamResponse = recordResponse(response, body, cp.allowReadingResponseBody(ex, response))
+		}
+
+		response, body = cp.filterResponse(ex, response, body)
+
+		if !cp.allowReadingResponseBody(ex, response) && hasResponseBody(response) && !ex.closeAfter &&
+			!isUpgradeRequest(request) {
+
+			cp.filterResponseFrames(ex, response)
+			cp.filterResponseStream(ex, response)
+		}
+
+		if ex.closeAfter || cp.proxy.isShuttingDown() && cp.isLastExchange() {
+			response.Close = true
+		}
+
+		if err := response.Write(cp.localConn); err != nil {
 			cp.close("response", err)
 			return
 		}
 
-		if n > 0 {
-			data := buffer[0:n]
+		cp.logFields(LogLevel_INFO, responseFields(ex, response, len(body)), "Response: HTTP", response.StatusCode)
+		cp.proxy.metrics.requestAnswered(ex, response)
+		cp.audit(ex, response, body, nil)
+		cp.record(ex, response, body)
+		cp.debug("Sent response data:", len(body), "bytes")
 
-			if response, err := reader.toResponse(cp.latestRequest); response != nil && err == nil {
-				requestUrl := "/<unknown>"
-				if response.Request != nil {
-					requestUrl = response.Request.URL.Path
-				}
+		if ex.closeAfter {
+			cp.close("response", errors.New("closing after a critical failure"))
+			return
+		}
 
-				var body []byte
+		switched := isUpgradeRequest(request) && isUpgradedResponse(response)
+		if ex.switched != nil {
+			ex.switched <- switched
+		}
 
-				if cp.allowReadingResponseBody(response) {
-					body, err = ioutil.ReadAll(response.Body)
-					if err != nil {
-						cp.close("response", err)
-						return
-					}
-					response.Body.Close()
+		if switched {
+			// the rest of the connection is a raw stream
+			n, err := io.Copy(cp.localConn, cp.filterOutputFrames(ex.upstream.reader, ex, response))
+			cp.debug("Sent raw stream data:", n, "bytes")
 
-					response.Request = cp.latestRequest
-					response.Body = ioutil.NopCloser(bytes.NewReader(body))
-				}
+			cp.close("response", err)
+			return
+		}
 
-				for _, handler := range cp.proxy.handlers {
-					if handler.responseFilter == nil {
-						continue
-					}
+		cp.endExchange()
+	}
+}
 
-					if !handler.pattern.MatchString(requestUrl) {
-						continue
-					}
+// filterResponse runs the response filters, and returns the response to send to the client with its body.
+func (cp *connectionPair) filterResponse(ex *exchange, response *http.Response, body []byte) (*http.Response, []byte) {
+	request := ex.request
+	requestUrl := request.URL.Path
 
-					if changedResponse, err := runResponseHandler(handler, response, body); err != nil {
-						if _, ok := err.(CriticalFailure); ok {
-							cp.error("Critical:", "Failed to execute response filter on", requestUrl, ":", err)
+	for _, handler := range ex.handlers {
+		if handler.responseFilter == nil {
+			continue
+		}
 
-							cp.localConn.writeFailedResponse("Failed to apply filter", err)
-							cp.close("response", err)
-							return
+		params, ok := handler.match(request)
+		if !ok {
+			continue
+		}
 
-						} else {
-							cp.warn("Response filter warning on", requestUrl, ":", err)
-						}
+		response.Request = withPathParams(request, params)
 
-					} else if changedResponse != nil {
-						response = changedResponse
-						body, _ = ioutil.ReadAll(changedResponse.Body)
-						changedResponse.Body.Close()
+		changedResponse, err := cp.runResponseHandler(handler, response, body)
+		ex.decisions = append(ex.decisions, handler.decision("response", changedResponse != nil, err))
 
-					}
+		if err != nil {
+			if denial, ok := asDenial(err); ok {
+				if _, critical := err.(CriticalFailure); critical {
+					cp.error("Critical:", "Failed to execute response filter on", requestUrl, ":", err)
+					ex.closeAfter = true
+				} else {
+					cp.warn("Response denied on", requestUrl, ":", err)
 				}
 
-				if len(body) > 0 {
-					response.Body = ioutil.NopCloser(bytes.NewReader(body))
+				if !cp.allowReadingResponseBody(ex, response) {
+					ex.closeAfter = true // the rest of the original body is still on the connection
 				}
 
-				response.Write(cp.localConn)
-
-				cp.info("Response: HTTP", response.StatusCode)
-				cp.debug("Sent response data:", len(body), "bytes")
+				response = denial.toResponse()
+				prepareDirectResponse(response, request)
+				body, _ = ioutil.ReadAll(response.Body)
+				break
 
 			} else {
-				cp.localConn.Write(data)
-				cp.debug("Sent response data:", n, "bytes")
+				cp.warn("Response filter warning on", requestUrl, ":", err)
+			}
 
+		} else if changedResponse != nil {
+			if changedResponse.Request == nil {
+				// like the ones created with NewResponse
+				prepareDirectResponse(changedResponse, request)
 			}
+
+			response = changedResponse
+			body, _ = ioutil.ReadAll(changedResponse.Body)
+			changedResponse.Body.Close()
+
 		}
 	}
+
+	if cp.allowReadingResponseBody(ex, response) && hasResponseBody(response) {
+		response.Body, response.ContentLength, response.TransferEncoding = bufferedBody(body)
+	} else if len(body) > 0 {
+		response.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	return response, body
 }
 
-func (cp *connectionPair) allowReadingResponseBody(response *http.Response) bool {
-	if cp.upgraded {
-		return false // the connection is upgraded (to raw stream)
+func (cp *connectionPair) readResponse(reader *bufio.Reader, request *http.Request) (*http.Response, error) {
+	response, err := http.ReadResponse(reader, request)
+	for err == nil && isInformational(response) {
+		// interim responses (like 100 Continue) precede the final one for the same request
+		if err = response.Write(cp.localConn); err == nil {
+			response, err = http.ReadResponse(reader, request)
+		}
 	}
 
-	if response == nil {
-		return false // we couldn't parse the response
+	return response, err
+}
+
+func (cp *connectionPair) allowReadingResponseBody(ex *exchange, response *http.Response) bool {
+	if isUpgradedResponse(response) {
+		return false // the connection is upgraded (to raw stream)
 	}
 
-	if response.Request == nil {
-		return false // we don't have the original request
+	if hasStreamFilters(ex.handlers, response.Request) {
+		return false // the body is filtered as it streams
 	}
 
 	url := response.Request.URL.Path
@@ -355,16 +647,18 @@ func (cp *connectionPair) allowReadingResponseBody(response *http.Response) bool
 	return true
 }
 
-func runResponseHandler(handler *handler, response *http.Response, body []byte) (changed *http.Response, err error) {
+func (cp *connectionPair) runResponseHandler(handler *handler, response *http.Response, body []byte) (changed *http.Response, err error) {
+	started := time.Now()
+	defer func() { cp.proxy.metrics.filterExecuted("response", started, changed != nil, err) }()
+
 	defer func() {
 		if r := recover(); r != nil {
-			fmt.Println(string(debug.Stack()))
-
 			switch r.(type) {
-			case SoftFailure, CriticalFailure:
+			case SoftFailure, CriticalFailure, Denial:
 				err = r.(error)
 			default:
-				err = NewCriticalFailure(r, "ResponseFilter")
+				cp.logFields(LogLevel_DEBUG, Fields{"stack": string(debug.Stack())}, "Response filter panicked:", r)
+				err = NewCriticalFailure(r, "ResponseFilter").WithStatus(http.StatusInternalServerError)
 			}
 		}
 	}()
@@ -373,56 +667,57 @@ func runResponseHandler(handler *handler, response *http.Response, body []byte)
 }
 
 func (cp *connectionPair) close(from string, err error) {
+	cp.lock.Lock()
+	if cp.closed {
+		cp.lock.Unlock()
+		return
+	}
+	cp.closed = true
+	close(cp.done)
+	cp.lock.Unlock()
+
 	cp.debug("Closing the connections:", err, "(from "+from+")")
 	cp.localConn.Close()
-	cp.remoteConn.Close()
-}
 
-type responseReader struct {
-	r io.Reader
-
-	cached []byte
+	for _, upstream := range cp.remotes {
+		upstream.Close()
+	}
 
-	startOver bool
+	cp.proxy.untrack(cp)
 }
 
-func (cr *responseReader) StartOver() {
-	cr.startOver = true
+// bufferedBody returns the body, content length and transfer encoding to send a fully buffered body with,
+// which is sent with its known length.
+func bufferedBody(body []byte) (io.ReadCloser, int64, []string) {
+	return ioutil.NopCloser(bytes.NewReader(body)), int64(len(body)), nil
 }
 
-func (cr *responseReader) Read(b []byte) (int, error) {
-	if cr.startOver {
-		ll := len(b)
-		if len(cr.cached) <= ll {
-			ll = len(cr.cached)
-			cr.startOver = false
-		}
-
-		copy(b[0:ll], cr.cached[0:ll])
-
-		cr.cached = cr.cached[ll:]
+func isUpgradeRequest(request *http.Request) bool {
+	return request.Header.Get("Upgrade") == "tcp"
+}
 
-		return ll, nil
+func isUpgradedResponse(response *http.Response) bool {
+	if response.StatusCode == http.StatusSwitchingProtocols {
+		return true
 	}
 
-	n, err := cr.r.Read(b)
-	if err == nil {
-		cr.cached = b[0:n]
+	// older daemons may hijack the connection without switching protocols
+	contentType := response.Header.Get("Content-Type")
+	return contentType == "application/vnd.docker.raw-stream" ||
+		contentType == "application/vnd.docker.multiplexed-stream"
+}
+
+func hasResponseBody(response *http.Response) bool {
+	if response.Request != nil && response.Request.Method == "HEAD" {
+		return false
 	}
 
-	return n, err
+	return response.StatusCode >= 200 &&
+		response.StatusCode != http.StatusNoContent &&
+		response.StatusCode != http.StatusNotModified
 }
 
-func (cr *responseReader) toResponse(req *http.Request) (*http.Response, error) {
-	if len(cr.cached) > 0 {
-		_, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(cr.cached)), req)
-		if err != nil {
-			return nil, err
-		}
-
-		cr.StartOver()
-		return http.ReadResponse(bufio.NewReaderSize(cr, len(cr.cached)), req)
-	} else {
-		return nil, fmt.Errorf("no request available")
-	}
+func isInformational(response *http.Response) bool {
+	return response.StatusCode >= 100 && response.StatusCode < 200 &&
+		response.StatusCode != http.StatusSwitchingProtocols
 }
@@ -0,0 +1,396 @@
+package connect
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RecordedExchange is a request and response pair passing through the proxy, as written by Record.
+type RecordedExchange struct {
+	Time         time.Time    `json:"time"`
+	RequestID    string       `json:"request_id"`
+	Listener     string       `json:"listener"`
+	ConnectionID int          `json:"connection_id"`
+	RemoteAddr   string       `json:"remote_addr,omitempty"`
+	Client       *AuditClient `json:"client,omitempty"`
+
+	// Request as received from the client
+	Request *RecordedRequest `json:"request"`
+	// Request as sent to the upstream, after the request filters, unless the proxy answered it
+	Forwarded *RecordedRequest `json:"forwarded,omitempty"`
+	// Response as read from the upstream, or merged from the upstreams by Aggregate, before the response filters
+	Upstream *RecordedResponse `json:"upstream,omitempty"`
+	// Response as sent to the client
+	Response *RecordedResponse `json:"response"`
+
+	Decisions []FilterDecision `json:"decisions"`
+}
+
+type RecordedRequest struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body,omitempty"`
+}
+
+type RecordedResponse struct {
+	StatusCode int         `json:"status"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body,omitempty"`
+
+	// Streamed responses were not buffered by the proxy, and their bodies are not recorded
+	Streamed bool `json:"streamed,omitempty"`
+}
+
+// DefaultRedactedHeaders are the headers the values of which are replaced in the recordings.
+var DefaultRedactedHeaders = []string{
+	"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Registry-Auth", "X-Registry-Config",
+}
+
+// recordRedactor replaces the secrets in the recorded requests and responses,
+// in the DefaultRedactedHeaders, and in the DefaultRedactedFields of the JSON bodies.
+var recordRedactor = newFieldRedactor(DefaultRedactedFields)
+
+type recorder struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// Record writes the exchanges passing through the proxy to the writer, as a JSON object per line,
+// with the requests and responses before and after the filters, to be replayed later with Replay.
+// The values of the DefaultRedactedHeaders and the DefaultRedactedFields in JSON bodies are not recorded.
+func (p *Proxy) Record(w io.Writer) {
+	p.recorder = &recorder{w: w}
+}
+
+func (cp *connectionPair) record(ex *exchange, response *http.Response, body []byte) {
+	r := cp.proxy.recorder
+	if r == nil || ex.received == nil {
+		return
+	}
+
+	rc := ContextOf(ex.request)
+
+	recorded := &RecordedExchange{
+		Time:         ex.started,
+		RequestID:    rc.RequestID,
+		Listener:     rc.Listener,
+		ConnectionID: rc.ConnectionID,
+		RemoteAddr:   rc.RemoteAddr,
+		Client:       auditClientOf(rc.Client),
+		Request:      ex.received,
+		Upstream:     ex.upstreamResponse,
+		Response:     recordResponse(response, body, cp.allowReadingResponseBody(ex, response)),
+		Decisions:    ex.decisions,
+	}
+
+	if ex.upstream != nil || ex.aggregated {
+		recorded.Forwarded = recordRequest(ex.request, ex.requestBody)
+	}
+
+	line, err := json.Marshal(recorded)
+	if err == nil {
+		r.lock.Lock()
+		_, err = r.w.Write(append(line, '\n'))
+		r.lock.Unlock()
+	}
+
+	if err != nil {
+		cp.error("Failed to record the exchange of", ex.request.URL, ":", err)
+	}
+}
+
+func recordRequest(request *http.Request, body []byte) *RecordedRequest {
+	return &RecordedRequest{
+		Method: request.Method,
+		URL:    request.URL.RequestURI(),
+		Header: redactHeader(request.Header),
+		Body:   redactBody(body),
+	}
+}
+
+func recordResponse(response *http.Response, body []byte, buffered bool) *RecordedResponse {
+	return &RecordedResponse{
+		StatusCode: response.StatusCode,
+		Header:     redactHeader(response.Header),
+		Body:       redactBody(body),
+		Streamed:   !buffered && hasResponseBody(response),
+	}
+}
+
+func redactHeader(header http.Header) http.Header {
+	redacted := cloneHeader(header)
+	for _, name := range DefaultRedactedHeaders {
+		if values := redacted[http.CanonicalHeaderKey(name)]; len(values) > 0 {
+			for idx := range values {
+				values[idx] = "***"
+			}
+		}
+	}
+
+	return redacted
+}
+
+// redactBody returns single JSON values with their secrets replaced, and other bodies as they are.
+func redactBody(body []byte) []byte {
+	if len(body) == 0 {
+		return body
+	}
+
+	var v interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	if decoder.Decode(&v) != nil || decoder.More() {
+		return body
+	}
+
+	redacted, err := json.Marshal(recordRedactor.redactValue(v))
+	if err != nil {
+		return body
+	}
+
+	return redacted
+}
+
+func cloneHeader(header http.Header) http.Header {
+	cloned := make(http.Header, len(header))
+	for key, values := range header {
+		cloned[key] = append([]string(nil), values...)
+	}
+
+	return cloned
+}
+
+// ReplayResult is the outcome of a recorded exchange replayed through the handlers of a proxy.
+type ReplayResult struct {
+	Recorded *RecordedExchange
+
+	Decisions []FilterDecision
+	// Request that would be sent to the upstream, nil if the proxy answers it
+	Forwarded *RecordedRequest
+	// Response the client would get, nil if the request is now sent to the upstream but it was not recorded
+	Response *RecordedResponse
+
+	// Differences describe what the handlers do differently from the recording, empty if nothing
+	Differences []string
+}
+
+// ReplayReport lists the results of a replayed recording, in the recorded order.
+type ReplayReport struct {
+	Results []*ReplayResult
+	Changed int
+}
+
+// Replay runs the exchanges recorded with Record through the request and response filters of the proxy,
+// without connecting to any upstream, and reports where the decisions, the requests sent to the upstream,
+// or the responses sent to the client would differ. The recorded upstream responses are passed to the
+// response filters, the streamed ones without their bodies, and the stream and frame filters are not run.
+// The requests for the endpoints of Aggregate are answered with the recorded merged lists too.
+// The clients are identified by the recorded credentials and certificate names, without the certificates.
+// The filters see the recorded requests and responses, with the secrets redacted.
+func (p *Proxy) Replay(r io.Reader) (*ReplayReport, error) {
+	report := &ReplayReport{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var recorded RecordedExchange
+		if err := json.Unmarshal(scanner.Bytes(), &recorded); err != nil {
+			return nil, fmt.Errorf("invalid recording on line %d: %s", line, err)
+		}
+		if recorded.Request == nil || recorded.Response == nil {
+			return nil, fmt.Errorf("invalid recording on line %d: missing request or response", line)
+		}
+
+		result, err := p.replayExchange(&recorded)
+		if err != nil {
+			return nil, fmt.Errorf("failed to replay line %d: %s", line, err)
+		}
+
+		report.Results = append(report.Results, result)
+		if len(result.Differences) > 0 {
+			report.Changed++
+		}
+	}
+
+	return report, scanner.Err()
+}
+
+func (p *Proxy) replayExchange(recorded *RecordedExchange) (*ReplayResult, error) {
+	request, err := http.NewRequest(recorded.Request.Method, recorded.Request.URL, bytes.NewReader(recorded.Request.Body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header = cloneHeader(recorded.Request.Header)
+	request.RequestURI = recorded.Request.URL
+
+	request = withRequestContext(request, &RequestContext{
+		Listener:     recorded.Listener,
+		ConnectionID: recorded.ConnectionID,
+		RemoteAddr:   recorded.RemoteAddr,
+		Client:       recorded.Client.identity(),
+		RequestID:    recorded.RequestID,
+	})
+
+	cp := &connectionPair{
+		localConn:    &localConnection{proxy: p, logPrefix: "replay"},
+		proxy:        p,
+		connectionId: recorded.ConnectionID,
+		replayed:     recorded,
+	}
+
+	ex := cp.filterRequest(p.currentHandlers(), request, recorded.Request.Body)
+	result := &ReplayResult{Recorded: recorded}
+
+	response := ex.response
+	if response != nil {
+		prepareDirectResponse(response, ex.request)
+
+	} else {
+		result.Forwarded = recordRequest(ex.request, ex.requestBody)
+
+		if route := p.routeFor(ex.request); route != nil {
+			ContextOf(ex.request).Upstream = route.name
+		}
+
+		if recorded.Upstream != nil {
+			response = recorded.Upstream.toResponse()
+			response.Request = ex.request
+		}
+	}
+
+	if response != nil {
+		var body []byte
+		if cp.allowReadingResponseBody(ex, response) {
+			body, _ = ioutil.ReadAll(response.Body)
+		}
+
+		response, body = cp.filterResponse(ex, response, body)
+		result.Response = recordResponse(response, body, cp.allowReadingResponseBody(ex, response))
+	}
+
+	result.Decisions = ex.decisions
+	result.Differences = replayDifferences(recorded, result)
+
+	return result, nil
+}
+
+func (r *RecordedResponse) toResponse() *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", r.StatusCode, http.StatusText(r.StatusCode)),
+		StatusCode:    r.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        cloneHeader(r.Header),
+		Body:          ioutil.NopCloser(bytes.NewReader(r.Body)),
+		ContentLength: int64(len(r.Body)),
+	}
+}
+
+func replayDifferences(recorded *RecordedExchange, result *ReplayResult) []string {
+	var differences []string
+
+	if !equalDecisions(recorded.Decisions, result.Decisions) {
+		differences = append(differences, fmt.Sprintf("decisions: %s -> %s",
+			formatDecisions(recorded.Decisions), formatDecisions(result.Decisions)))
+	}
+
+	switch {
+	case recorded.Forwarded == nil && result.Forwarded != nil:
+		differences = append(differences, "request: now sent to the upstream")
+	case recorded.Forwarded != nil && result.Forwarded == nil:
+		differences = append(differences, "request: no longer sent to the upstream")
+	case recorded.Forwarded != nil:
+		if recorded.Forwarded.Method != result.Forwarded.Method || recorded.Forwarded.URL != result.Forwarded.URL {
+			differences = append(differences, fmt.Sprintf("request: %s %s -> %s %s",
+				recorded.Forwarded.Method, recorded.Forwarded.URL, result.Forwarded.Method, result.Forwarded.URL))
+		}
+		if !bytes.Equal(recorded.Forwarded.Body, result.Forwarded.Body) {
+			differences = append(differences, "request body: "+formatBodyChange(recorded.Forwarded.Body, result.Forwarded.Body))
+		}
+	}
+
+	if result.Response == nil {
+		return append(differences, "response: unknown, the upstream response was not recorded")
+	}
+
+	if recorded.Response.StatusCode != result.Response.StatusCode {
+		differences = append(differences, fmt.Sprintf("response status: %d -> %d",
+			recorded.Response.StatusCode, result.Response.StatusCode))
+	}
+	if !recorded.Response.Streamed && !result.Response.Streamed && !bytes.Equal(recorded.Response.Body, result.Response.Body) {
+		differences = append(differences, "response body: "+formatBodyChange(recorded.Response.Body, result.Response.Body))
+	}
+
+	return differences
+}
+
+func equalDecisions(a, b []FilterDecision) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for idx := range a {
+		if a[idx] != b[idx] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func formatDecisions(decisions []FilterDecision) string {
+	var buffer bytes.Buffer
+
+	buffer.WriteString("[")
+	for idx, decision := range decisions {
+		if idx > 0 {
+			buffer.WriteString(", ")
+		}
+		fmt.Fprintf(&buffer, "%s %s: %s", decision.Kind, decision.Handler, decision.Outcome)
+	}
+	buffer.WriteString("]")
+
+	return buffer.String()
+}
+
+func formatBodyChange(before, after []byte) string {
+	const maxLength = 200
+
+	shorten := func(body []byte) string {
+		if len(body) > maxLength {
+			return fmt.Sprintf("%q... (%d bytes)", body[:maxLength], len(body))
+		}
+		return fmt.Sprintf("%q", body)
+	}
+
+	return shorten(before) + " -> " + shorten(after)
+}
+
+func (c *AuditClient) identity() *ClientIdentity {
+	client := &ClientIdentity{}
+	if c == nil {
+		return client
+	}
+
+	if c.Uid != nil && c.Gid != nil && c.Pid != nil {
+		client.Credentials = &PeerCredentials{Uid: *c.Uid, Gid: *c.Gid, Pid: *c.Pid}
+	}
+	client.Subject, client.CommonName, client.SANs = c.Subject, c.CommonName, c.SANs
+
+	return client
+}
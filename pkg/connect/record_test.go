@@ -0,0 +1,141 @@
+package connect
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	SetLogLevel(LogLevel_ERROR)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"Path":"` + r.URL.Path + `"}`))
+	}))
+	defer server.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen:", err)
+	}
+	defer listener.Close()
+
+	proxy := NewProxy(func() (net.Conn, error) {
+		return net.Dial("tcp", server.Listener.Addr().String())
+	})
+	proxy.AddListener("", listener)
+
+	recording := &lockedBuffer{}
+	proxy.Record(recording)
+
+	addLabel := FilterRequestAsJson(
+		func() T { return &map[string]interface{}{} },
+		func(req T) T {
+			payload := *req.(*map[string]interface{})
+			payload["Labels"] = map[string]string{"ci": "1"}
+			return payload
+		})
+
+	proxy.On("POST", "/containers/create", addLabel)
+	proxy.Aggregate("/volumes", NewUpstream("local", func() (net.Conn, error) {
+		return net.Dial("tcp", server.Listener.Addr().String())
+	}))
+
+	go proxy.Process(context.Background())
+
+	address := "http://" + listener.Addr().String()
+
+	for _, path := range []string{"/containers/create", "/info"} {
+		request, _ := http.NewRequest("POST", address+path, strings.NewReader(`{"Image":"alpine","Env":["TOKEN=hunter2"]}`))
+		request.Header.Set("X-Registry-Auth", "c2VjcmV0")
+
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal("Failed to send the request:", err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	var volumes map[string]interface{}
+	getJson(t, address+"/volumes", &volumes)
+
+	// the exchanges are recorded after the responses are sent
+	deadline := time.Now().Add(time.Second)
+	for strings.Count(recording.String(), "\n") < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if strings.Contains(recording.String(), "hunter2") || strings.Contains(recording.String(), "c2VjcmV0") {
+		t.Error("Secrets were not redacted:", recording.String())
+	}
+
+	offline := func() (net.Conn, error) {
+		return nil, errors.New("replays do not connect to the upstreams")
+	}
+	notDialed := NewUpstream("local", func() (net.Conn, error) {
+		t.Error("Replays do not connect to the aggregated upstreams")
+		return offline()
+	})
+
+	// the same handlers make the same decisions
+	same := NewProxy(offline)
+	same.On("POST", "/containers/create", addLabel)
+	same.Aggregate("/volumes", notDialed)
+
+	report, err := same.Replay(strings.NewReader(recording.String()))
+	if err != nil {
+		t.Fatal("Failed to replay:", err)
+	}
+
+	if len(report.Results) != 3 || report.Changed != 0 {
+		for _, result := range report.Results {
+			t.Log(result.Recorded.Request.URL, result.Differences)
+		}
+		t.Fatal("Unexpected replay of the same handlers:", len(report.Results), report.Changed)
+	}
+
+	// a tightened policy denies creating containers, and rewrites the info response
+	tightened := NewProxy(offline)
+	tightened.Aggregate("/volumes", notDialed)
+	tightened.On("POST", "/containers/create", func(req *http.Request, body []byte) (*http.Request, error) {
+		return nil, NewDenial(http.StatusForbidden, "not allowed")
+	})
+	tightened.OnResponse("*", "/info", func(resp *http.Response, body []byte) (*http.Response, error) {
+		return NewResponse(http.StatusOK, "application/json", []byte(`{}`)), nil
+	})
+
+	report, err = tightened.Replay(strings.NewReader(recording.String()))
+	if err != nil {
+		t.Fatal("Failed to replay:", err)
+	}
+
+	if len(report.Results) != 3 || report.Changed != 2 {
+		t.Fatal("Unexpected replay of the tightened handlers:", len(report.Results), report.Changed)
+	}
+
+	create, info := report.Results[0], report.Results[1]
+
+	if create.Forwarded != nil || create.Response.StatusCode != http.StatusForbidden {
+		t.Error("Unexpected replay result:", create.Forwarded, create.Response)
+	}
+	if differences := strings.Join(create.Differences, "\n"); !strings.Contains(differences, "request: no longer sent to the upstream") ||
+		!strings.Contains(differences, "response status: 200 -> 403") ||
+		!strings.Contains(differences, "request POST /containers/create: modified] -> [request POST /containers/create: denied]") {
+		t.Error("Unexpected differences:", differences)
+	}
+
+	if info.Forwarded == nil || string(info.Response.Body) != `{}` {
+		t.Error("Unexpected replay result:", info.Forwarded, info.Response)
+	}
+	if differences := strings.Join(info.Differences, "\n"); !strings.Contains(differences, `response body: "{\"Path\":\"/info\"}" -> "{}"`) {
+		t.Error("Unexpected differences:", differences)
+	}
+}
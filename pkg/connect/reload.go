@@ -0,0 +1,51 @@
+package connect
+
+import (
+	"fmt"
+)
+
+// ReloadHandlers replaces every filter of the proxy with the ones the configure function registers
+// on the proxy passed to it, which is only meant for registering filters, like with On or ApplyPolicy.
+// The new filters apply to the next request read on both new and existing connections,
+// while the requests in flight, and the streams already attached, finish with the previous ones.
+// The filters are not changed if the configure function fails or panics.
+// The routes and the aggregated endpoints are not filters, they are kept as they are.
+func (p *Proxy) ReloadHandlers(configure func(p *Proxy) error) (err error) {
+	staging := &Proxy{}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("failed to register the filters: %v", r)
+		}
+	}()
+
+	if err := configure(staging); err != nil {
+		return err
+	}
+
+	p.handlersLock.Lock()
+	defer p.handlersLock.Unlock()
+
+	p.handlers = staging.handlers
+
+	return nil
+}
+
+// addHandler registers a filter without changing the ones already taken by an exchange in flight.
+func (p *Proxy) addHandler(h *handler) {
+	p.handlersLock.Lock()
+	defer p.handlersLock.Unlock()
+
+	handlers := make([]*handler, len(p.handlers), len(p.handlers)+1)
+	copy(handlers, p.handlers)
+
+	p.handlers = append(handlers, h)
+}
+
+// currentHandlers returns the filters to use for a new exchange.
+func (p *Proxy) currentHandlers() []*handler {
+	p.handlersLock.RLock()
+	defer p.handlersLock.RUnlock()
+
+	return p.handlers
+}
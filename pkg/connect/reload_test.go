@@ -0,0 +1,120 @@
+package connect_test
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/rycus86/docker-filter/pkg/connect"
+	"github.com/rycus86/docker-filter/pkg/connect/connecttest"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReloadHandlers(t *testing.T) {
+	env := connecttest.New(t)
+
+	// the daemon waits for the slow request when it is closed
+	pending := make(chan struct{})
+	var releaseOnce sync.Once
+	release := func() { releaseOnce.Do(func() { close(pending) }) }
+	defer release()
+
+	env.Daemon.Handle("GET", "/slow", func(w http.ResponseWriter, r *http.Request) {
+		<-pending
+		w.Write([]byte("OK"))
+	})
+	env.Start()
+
+	proxy, address := env.Proxy, strings.TrimPrefix(env.Address(), "tcp://")
+
+	filterWith := func(name string) func(p *connect.Proxy) error {
+		return func(p *connect.Proxy) error {
+			p.FilterResponses("/", func(resp *http.Response, body []byte) (*http.Response, error) {
+				resp.Header.Set("X-Filter", name)
+				return nil, nil
+			})
+			return nil
+		}
+	}
+
+	if err := proxy.ReloadHandlers(filterWith("old")); err != nil {
+		t.Fatal("Failed to load the filters:", err)
+	}
+
+	slow, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal("Failed to connect:", err)
+	}
+	defer slow.Close()
+
+	fmt.Fprint(slow, "GET /slow HTTP/1.1\r\nHost: docker\r\n\r\n")
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal("Failed to connect:", err)
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+
+	ping := func() string {
+		fmt.Fprint(conn, "GET /_ping HTTP/1.1\r\nHost: docker\r\n\r\n")
+
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal("Failed to read the response:", err)
+		}
+		resp.Body.Close()
+
+		return resp.Header.Get("X-Filter")
+	}
+
+	if filter := ping(); filter != "old" {
+		t.Error("Unexpected filter before the reload:", filter)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	if err := proxy.ReloadHandlers(filterWith("new")); err != nil {
+		t.Fatal("Failed to reload the filters:", err)
+	}
+
+	if filter := ping(); filter != "new" {
+		t.Error("Unexpected filter on the existing connection after the reload:", filter)
+	}
+
+	if err := proxy.ReloadHandlers(func(p *connect.Proxy) error {
+		filterWith("failed")(p)
+		return errors.New("invalid configuration")
+	}); err == nil || err.Error() != "invalid configuration" {
+		t.Error("Unexpected reload error:", err)
+	}
+
+	if err := proxy.ReloadHandlers(func(p *connect.Proxy) error {
+		filterWith("panicked")(p)
+		p.FilterRequests("(", nil)
+		return nil
+	}); err == nil {
+		t.Error("Expected a reload error for an invalid pattern")
+	}
+
+	if filter := ping(); filter != "new" {
+		t.Error("Unexpected filter after the failed reloads:", filter)
+	}
+
+	release()
+
+	resp, err := http.ReadResponse(bufio.NewReader(slow), nil)
+	if err != nil {
+		t.Fatal("Failed to read the response:", err)
+	}
+	resp.Body.Close()
+
+	if filter := resp.Header.Get("X-Filter"); filter != "old" {
+		t.Error("Unexpected filter for the request in flight during the reload:", filter)
+	}
+}
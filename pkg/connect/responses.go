@@ -0,0 +1,75 @@
+package connect
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// NewResponse creates a response that request filters can send to the client
+// in place of the one from the remote, with NewDirectResponse, or response filters can return.
+func NewResponse(statusCode int, contentType string, body []byte) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		StatusCode:    statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {contentType}},
+		ContentLength: int64(len(body)),
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+	}
+}
+
+func NewJsonResponse(statusCode int, v T) *http.Response {
+	body, err := json.Marshal(v)
+	if err != nil {
+		panic(NewCriticalFailure(err, "JSON"))
+	}
+
+	return NewResponse(statusCode, "application/json", body)
+}
+
+func prepareDirectResponse(response *http.Response, request *http.Request) {
+	if response.ProtoMajor == 0 {
+		response.Proto, response.ProtoMajor, response.ProtoMinor = "HTTP/1.1", 1, 1
+	}
+
+	if response.Header == nil {
+		response.Header = http.Header{}
+	}
+
+	if response.Body == nil {
+		response.Body = http.NoBody
+	}
+
+	response.Request = request
+}
+
+func (d Denial) toResponse() *http.Response {
+	statusCode := d.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusForbidden
+	}
+
+	return NewJsonResponse(statusCode, &struct {
+		Message string `json:"message"`
+	}{d.Message})
+}
+
+func asDenial(err error) (Denial, bool) {
+	switch failure := err.(type) {
+	case Denial:
+		return failure, true
+	case CriticalFailure:
+		return Denial{failure.StatusCode, failure.Error()}, true
+	case SoftFailure:
+		if failure.StatusCode != 0 {
+			return Denial{failure.StatusCode, failure.Error()}, true
+		}
+	}
+
+	return Denial{}, false
+}
@@ -0,0 +1,79 @@
+package connect
+
+import (
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// RouteMatcher decides whether a request is sent to the upstream of a route.
+type RouteMatcher func(req *http.Request) bool
+
+// Route sends the requests matching the rule to a different upstream than the one the proxy
+// was created with. The routes are checked in the order they were added, after the request
+// filters have run, and their upstreams are only connected to when a request is routed there.
+func (p *Proxy) Route(name string, match RouteMatcher, dialer func() (net.Conn, error)) {
+	p.routes = append(p.routes, &route{
+		name:   name,
+		match:  match,
+		dialer: dialer,
+	})
+}
+
+// RouteByPath matches requests with the given HTTP method (or * for any) and path template, see On.
+func RouteByPath(method, pathTemplate string) RouteMatcher {
+	h := &handler{method: method, pattern: CompilePathTemplate(pathTemplate)}
+
+	return func(req *http.Request) bool {
+		_, ok := h.match(req)
+		return ok
+	}
+}
+
+// RouteByPathPrefix matches requests for any of the given paths, like /services,
+// or anything below them, ignoring the optional API version prefix.
+func RouteByPathPrefix(prefixes ...string) RouteMatcher {
+	var quoted []string
+	for _, prefix := range prefixes {
+		quoted = append(quoted, regexp.QuoteMeta(strings.TrimSuffix(prefix, "/")))
+	}
+
+	pattern := regexp.MustCompile("^(?:/v[0-9.]+)?(?:" + strings.Join(quoted, "|") + ")(?:/|$)")
+
+	return func(req *http.Request) bool {
+		return pattern.MatchString(req.URL.Path)
+	}
+}
+
+// RouteByHeader matches requests with a header value matching the regular expression.
+func RouteByHeader(name, valuePattern string) RouteMatcher {
+	pattern := regexp.MustCompile(valuePattern)
+
+	return func(req *http.Request) bool {
+		for _, value := range req.Header[http.CanonicalHeaderKey(name)] {
+			if pattern.MatchString(value) {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// RouteByClient matches requests from clients accepted by the given function, see ClientOf.
+func RouteByClient(accept func(client *ClientIdentity) bool) RouteMatcher {
+	return func(req *http.Request) bool {
+		return accept(ClientOf(req))
+	}
+}
+
+func (p *Proxy) routeFor(request *http.Request) *route {
+	for _, route := range p.routes {
+		if route.match(request) {
+			return route
+		}
+	}
+
+	return nil // the default upstream
+}
@@ -0,0 +1,96 @@
+package connect
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRoutingByRules(t *testing.T) {
+	SetLogLevel(LogLevel_ERROR)
+
+	startServer := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name + ":" + r.URL.Path))
+		}))
+	}
+
+	dialerFor := func(server *httptest.Server) func() (net.Conn, error) {
+		return func() (net.Conn, error) {
+			return net.Dial("tcp", server.Listener.Addr().String())
+		}
+	}
+
+	local := startServer("local")
+	defer local.Close()
+
+	manager := startServer("manager")
+	defer manager.Close()
+
+	builder := startServer("builder")
+	defer builder.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen:", err)
+	}
+	defer listener.Close()
+
+	proxy := NewProxy(dialerFor(local))
+	proxy.AddListener("", listener)
+
+	proxy.Route("manager", RouteByPathPrefix("/services", "/nodes", "/secrets"), dialerFor(manager))
+	proxy.Route("builder", RouteByHeader("X-Builder", "^yes$"), dialerFor(builder))
+	proxy.Route("builds", RouteByPath("POST", "/build"), dialerFor(builder))
+	proxy.Route("offline", RouteByPath("GET", "/swarm"), func() (net.Conn, error) {
+		return nil, errors.New("not reachable")
+	})
+
+	upstreams := map[string]string{}
+	proxy.FilterResponses(".*", func(resp *http.Response, body []byte) (*http.Response, error) {
+		upstreams[resp.Request.URL.Path] = ContextOf(resp.Request).Upstream
+		return nil, nil
+	})
+
+	go proxy.Process(context.Background())
+
+	// the same client connection is used for every request
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 1}}
+
+	for _, tc := range []struct {
+		method, path, header, expected string
+	}{
+		{"GET", "/v1.40/services", "", "manager:/v1.40/services"},
+		{"GET", "/containers/json", "", "local:/containers/json"},
+		{"GET", "/nodes/abcd", "", "manager:/nodes/abcd"},
+		{"GET", "/nodesx", "", "local:/nodesx"},
+		{"GET", "/info", "yes", "builder:/info"},
+		{"POST", "/build", "", "builder:/build"},
+		{"GET", "/swarm", "", `{"message":"Failed to connect the proxy to the remote: not reachable"}`},
+		{"GET", "/version", "", "local:/version"},
+	} {
+		req, _ := http.NewRequest(tc.method, "http://"+listener.Addr().String()+tc.path, nil)
+		if tc.header != "" {
+			req.Header.Set("X-Builder", tc.header)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal("Failed to send the request to", tc.path, ":", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if string(body) != tc.expected {
+			t.Errorf("Unexpected response for %s: %s %s", tc.path, resp.Status, body)
+		}
+	}
+
+	if upstreams["/v1.40/services"] != "manager" || upstreams["/info"] != "builder" || upstreams["/version"] != "" {
+		t.Error("Unexpected upstreams in the request context:", upstreams)
+	}
+}
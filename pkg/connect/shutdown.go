@@ -0,0 +1,142 @@
+package connect
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var ErrProxyClosed = errors.New("proxy closed")
+
+const shutdownPollInterval = 100 * time.Millisecond
+
+// Shutdown stops accepting connections and closes the existing ones as they become idle,
+// until the context is done, when the rest are closed forcibly (upgraded streams included).
+func (p *Proxy) Shutdown(ctx context.Context) (int, error) {
+	p.lock.Lock()
+	p.shuttingDown = true
+	open := len(p.pairs)
+	p.lock.Unlock()
+
+	p.closeAll()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if p.closeIdlePairs() == 0 {
+			return open, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			forced := p.closeAllPairs()
+			return open - forced, ctx.Err()
+
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Proxy) isShuttingDown() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.shuttingDown
+}
+
+func (p *Proxy) track(cp *connectionPair) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.shuttingDown {
+		return false
+	}
+
+	p.pairs[cp] = struct{}{}
+	return true
+}
+
+func (p *Proxy) untrack(cp *connectionPair) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	delete(p.pairs, cp)
+}
+
+func (p *Proxy) trackedPairs() []*connectionPair {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	pairs := make([]*connectionPair, 0, len(p.pairs))
+	for cp := range p.pairs {
+		pairs = append(pairs, cp)
+	}
+
+	return pairs
+}
+
+func (p *Proxy) closeIdlePairs() (remaining int) {
+	for _, cp := range p.trackedPairs() {
+		if cp.isIdle() {
+			cp.close("shutdown", ErrProxyClosed)
+		} else {
+			remaining++
+		}
+	}
+
+	return
+}
+
+func (p *Proxy) closeAllPairs() (closed int) {
+	for _, cp := range p.trackedPairs() {
+		cp.close("shutdown", ErrProxyClosed)
+		closed++
+	}
+
+	return
+}
+
+func (cp *connectionPair) beginExchange() bool {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	if cp.closed {
+		return false
+	}
+
+	cp.inFlight++
+	return true
+}
+
+func (cp *connectionPair) endExchange() {
+	cp.lock.Lock()
+	cp.inFlight--
+	idle := cp.inFlight == 0 && !cp.upgraded
+	cp.lock.Unlock()
+
+	if idle && cp.proxy.isShuttingDown() {
+		cp.close("shutdown", ErrProxyClosed)
+	}
+}
+
+func (cp *connectionPair) isLastExchange() bool {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	return cp.inFlight <= 1
+}
+
+func (cp *connectionPair) markUpgraded() {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	cp.upgraded = true
+}
+
+func (cp *connectionPair) isIdle() bool {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	return cp.inFlight == 0 && !cp.upgraded
+}
@@ -0,0 +1,172 @@
+package connect
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func startShutdownTestProxy(t *testing.T, server *httptest.Server) (*Proxy, net.Listener, chan error) {
+	SetLogLevel(LogLevel_WARN)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen:", err)
+	}
+
+	proxy := NewProxy(func() (net.Conn, error) {
+		return net.Dial("tcp", server.Listener.Addr().String())
+	})
+	proxy.AddListener("test", listener)
+
+	processed := make(chan error, 1)
+	go func() {
+		processed <- proxy.Process(context.Background())
+	}()
+
+	return proxy, listener, processed
+}
+
+func TestShutdownDrainsInFlightRequests(t *testing.T) {
+	release := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		w.Write([]byte("OK"))
+	}))
+	defer server.Close()
+
+	proxy, listener, processed := startShutdownTestProxy(t, server)
+
+	idle, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal("Failed to connect:", err)
+	}
+	defer idle.Close()
+
+	fmt.Fprint(idle, "GET /_ping HTTP/1.1\r\nHost: docker\r\n\r\n")
+	idleReader := bufio.NewReader(idle)
+	if resp, err := http.ReadResponse(idleReader, nil); err != nil || resp.StatusCode != 200 {
+		t.Fatal("Unexpected response:", resp, err)
+	}
+
+	busy, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal("Failed to connect:", err)
+	}
+	defer busy.Close()
+
+	fmt.Fprint(busy, "GET /slow HTTP/1.1\r\nHost: docker\r\n\r\n")
+	time.Sleep(50 * time.Millisecond)
+
+	type shutdownResult struct {
+		drained int
+		err     error
+	}
+	shutdown := make(chan shutdownResult, 1)
+	go func() {
+		drained, err := proxy.Shutdown(context.Background())
+		shutdown <- shutdownResult{drained, err}
+	}()
+
+	if err := <-processed; err != ErrProxyClosed {
+		t.Error("Unexpected result from Process:", err)
+	}
+
+	if _, err := http.ReadResponse(idleReader, nil); err == nil {
+		t.Error("Expected the idle connection to be closed")
+	}
+
+	close(release)
+
+	resp, err := http.ReadResponse(bufio.NewReader(busy), nil)
+	if err != nil {
+		t.Fatal("Failed to read the in-flight response:", err)
+	}
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != "OK" || !resp.Close {
+		t.Error("Unexpected in-flight response:", string(body), resp.Header)
+	}
+
+	select {
+	case result := <-shutdown:
+		if result.err != nil || result.drained != 2 {
+			t.Error("Unexpected shutdown result:", result.drained, result.err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Shutdown did not finish in time")
+	}
+}
+
+func TestShutdownClosesUpgradedStreamsOnDeadline(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buffered, _ := w.(http.Hijacker).Hijack()
+		defer conn.Close()
+
+		buffered.WriteString("HTTP/1.1 101 UPGRADED\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+		buffered.Flush()
+
+		ioutil.ReadAll(conn)
+	}))
+	defer server.Close()
+
+	proxy, listener, _ := startShutdownTestProxy(t, server)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal("Failed to connect:", err)
+	}
+	defer conn.Close()
+
+	fmt.Fprint(conn, "POST /containers/x/attach HTTP/1.1\r\nHost: docker\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	if resp, err := http.ReadResponse(reader, nil); err != nil || resp.StatusCode != 101 {
+		t.Fatal("Unexpected response:", resp, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	drained, err := proxy.Shutdown(ctx)
+	if err != context.DeadlineExceeded || drained != 0 {
+		t.Error("Unexpected shutdown result:", drained, err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := reader.ReadByte(); err == nil {
+		t.Error("Expected the upgraded connection to be closed")
+	}
+}
+
+func TestEnqueueAfterClose(t *testing.T) {
+	cp := &connectionPair{
+		pending: make(chan *exchange, 1),
+		done:    make(chan struct{}),
+	}
+
+	if !cp.enqueue(&exchange{}) {
+		t.Fatal("Expected the exchange to be queued")
+	}
+
+	// the queue is full, and nothing reads it after the connections are closed
+	close(cp.done)
+
+	queued := make(chan bool)
+	go func() { queued <- cp.enqueue(&exchange{}) }()
+
+	select {
+	case ok := <-queued:
+		if ok {
+			t.Error("Expected the exchange not to be queued")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out queueing the exchange")
+	}
+}
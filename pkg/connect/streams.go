@@ -0,0 +1,229 @@
+package connect
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// DropChunk can be returned (or panicked with) from a StreamFilterFunc to leave the chunk out of the response.
+var DropChunk = errors.New("drop chunk")
+
+const streamChunkSize = 32 * 1024
+
+// FilterResponseStream registers a filter for streamed response bodies, like the ones of /events or /logs.
+// The filter receives every newline-delimited object of JSON responses, or every chunk
+// of the body as it arrives otherwise, and the response is sent to the client chunked.
+func (p *Proxy) FilterResponseStream(urlPattern string, filterFunc StreamFilterFunc) {
+	p.addHandler(&handler{
+		path:         urlPattern,
+		pattern:      regexp.MustCompile(urlPattern),
+		streamFilter: filterFunc,
+	})
+}
+
+// OnResponseStream registers a stream filter with a method and path template, see On.
+func (p *Proxy) OnResponseStream(method, pathTemplate string, filterFunc StreamFilterFunc) {
+	p.addHandler(&handler{
+		method:       method,
+		path:         pathTemplate,
+		pattern:      CompilePathTemplate(pathTemplate),
+		streamFilter: filterFunc,
+	})
+}
+
+func FilterStreamAsJson(provideValue func() T, change func(T) T) StreamFilterFunc {
+	return func(resp *http.Response, chunk []byte) ([]byte, error) {
+		v := provideValue()
+
+		if err := json.Unmarshal(chunk, v); err != nil {
+			return nil, NewSoftFailure(err, "JSON")
+		}
+
+		if changed := change(v); changed != nil {
+			v = changed
+		} else {
+			return nil, nil
+		}
+
+		if changedChunk, err := json.Marshal(v); err != nil {
+			return nil, NewCriticalFailure(err, "JSON")
+		} else {
+			return changedChunk, nil
+		}
+	}
+}
+
+type boundStreamFilter struct {
+	handler  *handler
+	response *http.Response
+}
+
+func streamFiltersFor(handlers []*handler, response *http.Response) []*boundStreamFilter {
+	var filters []*boundStreamFilter
+
+	for _, handler := range handlers {
+		if handler.streamFilter == nil {
+			continue
+		}
+
+		if params, ok := handler.match(response.Request); ok {
+			bound := new(http.Response)
+			*bound = *response
+			bound.Request = withPathParams(response.Request, params)
+
+			filters = append(filters, &boundStreamFilter{handler: handler, response: bound})
+		}
+	}
+
+	return filters
+}
+
+func hasStreamFilters(handlers []*handler, request *http.Request) bool {
+	for _, handler := range handlers {
+		if handler.streamFilter == nil && handler.frameFilter == nil {
+			continue
+		}
+
+		if _, ok := handler.match(request); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (cp *connectionPair) filterResponseStream(ex *exchange, response *http.Response) {
+	filters := streamFiltersFor(ex.handlers, response)
+	if len(filters) == 0 {
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+
+	response.Body = &streamFilteringReader{
+		cp:      cp,
+		body:    response.Body,
+		source:  bufio.NewReaderSize(response.Body, streamChunkSize),
+		lines:   mediaType == "application/json",
+		filters: filters,
+	}
+
+	makeChunked(response)
+}
+
+// makeChunked sends the response with chunked encoding, because the filters may change the size of its body.
+func makeChunked(response *http.Response) {
+	response.ContentLength = -1
+	response.TransferEncoding = []string{"chunked"}
+}
+
+type streamFilteringReader struct {
+	cp *connectionPair
+
+	body   io.ReadCloser
+	source *bufio.Reader
+	lines  bool
+
+	filters []*boundStreamFilter
+
+	pending []byte
+	err     error
+}
+
+func (r *streamFilteringReader) Read(b []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		chunk, err := r.next()
+		if len(chunk) > 0 {
+			r.pending, r.err = r.apply(chunk)
+		}
+		if r.err == nil {
+			r.err = err
+		}
+	}
+
+	n := copy(b, r.pending)
+	r.pending = r.pending[n:]
+
+	return n, nil
+}
+
+func (r *streamFilteringReader) Close() error {
+	return r.body.Close()
+}
+
+func (r *streamFilteringReader) next() ([]byte, error) {
+	if r.lines {
+		return r.source.ReadBytes('\n')
+	}
+
+	chunk := make([]byte, streamChunkSize)
+	n, err := r.source.Read(chunk)
+	return chunk[:n], err
+}
+
+func (r *streamFilteringReader) apply(chunk []byte) ([]byte, error) {
+	if r.lines {
+		if chunk = bytes.TrimRight(chunk, "\r\n"); len(chunk) == 0 {
+			return []byte("\n"), nil
+		}
+	}
+
+	for _, filter := range r.filters {
+		requestUrl := filter.response.Request.URL.Path
+
+		if changed, err := r.cp.runStreamHandler(filter.handler, filter.response, chunk); err != nil {
+			if err == DropChunk {
+				return nil, nil
+			} else if _, ok := err.(SoftFailure); ok {
+				r.cp.warn("Stream filter warning on", requestUrl, ":", err)
+			} else {
+				r.cp.error("Critical:", "Failed to execute stream filter on", requestUrl, ":", err)
+				return nil, err
+			}
+
+		} else if changed != nil {
+			chunk = changed
+
+		}
+	}
+
+	if r.lines {
+		return append(chunk, '\n'), nil
+	}
+
+	return chunk, nil
+}
+
+func (cp *connectionPair) runStreamHandler(handler *handler, response *http.Response, chunk []byte) (changed []byte, err error) {
+	started := time.Now()
+	defer func() { cp.proxy.metrics.filterExecuted("stream", started, changed != nil, err) }()
+
+	defer func() {
+		if r := recover(); r != nil {
+			if r == DropChunk {
+				err = DropChunk
+				return
+			}
+
+			switch r.(type) {
+			case SoftFailure, CriticalFailure, Denial:
+				err = r.(error)
+			default:
+				err = NewCriticalFailure(r, "StreamFilter")
+			}
+		}
+	}()
+
+	return handler.streamFilter(response, chunk)
+}
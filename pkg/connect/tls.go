@@ -0,0 +1,160 @@
+package connect
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	tlsHandshakeTimeout = 10 * time.Second
+	tlsDialTimeout      = 30 * time.Second
+)
+
+// TLSOptions follow the flags of the Docker daemon and client: the CA bundle to verify the
+// other side with, the certificate and key to present, and whether verification is required.
+type TLSOptions struct {
+	CAFile   string
+	CertFile string
+	KeyFile  string
+	Verify   bool
+}
+
+// AddTLSListener adds a listener that terminates TLS with the given configuration,
+// see ServerTLSConfig, and exposes the verified client certificates through ClientOf.
+func (p *Proxy) AddTLSListener(prefix string, listener net.Listener, config *tls.Config) {
+	if prefix == "" {
+		prefix = listener.Addr().Network() + "+tls"
+	}
+
+	p.AddListener(prefix, tls.NewListener(listener, config))
+}
+
+// ServerTLSConfig creates the configuration for TLS listeners, like `dockerd --tlsverify` would,
+// requiring client certificates signed by the CA when Verify is set.
+func ServerTLSConfig(options TLSOptions) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if options.CAFile != "" {
+		pool, err := loadCertPool(options.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	} else if options.Verify {
+		return nil, errors.New("a CA file is required to verify client certificates")
+	}
+
+	if options.Verify {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+// CertPathOptions returns the options for the ca.pem, cert.pem and key.pem files
+// in the given directory, the same layout the Docker client expects in DOCKER_CERT_PATH.
+func CertPathOptions(certPath string) TLSOptions {
+	return TLSOptions{
+		CAFile:   filepath.Join(certPath, "ca.pem"),
+		CertFile: filepath.Join(certPath, "cert.pem"),
+		KeyFile:  filepath.Join(certPath, "key.pem"),
+		Verify:   true,
+	}
+}
+
+// ClientTLSConfig creates the configuration for connecting to a TLS enabled daemon, like
+// `docker --tlsverify` would, verifying the daemon certificate against the CA when Verify is set.
+func ClientTLSConfig(options TLSOptions) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: !options.Verify,
+	}
+
+	if options.CAFile != "" {
+		pool, err := loadCertPool(options.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = pool
+	}
+
+	if options.CertFile != "" || options.KeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
+
+// TLSDialer returns a dialer for NewProxy that connects to a daemon at an address
+// like tcp://host:2376 using TLS, with the host name used for SNI and verification.
+func TLSDialer(address string, options TLSOptions) (func() (net.Conn, error), error) {
+	config, err := ClientTLSConfig(options)
+	if err != nil {
+		return nil, err
+	}
+
+	address = strings.TrimPrefix(address, "tcp://")
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	config.ServerName = host
+
+	return func() (net.Conn, error) {
+		return tls.DialWithDialer(&net.Dialer{Timeout: tlsDialTimeout}, "tcp", address, config)
+	}, nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in " + caFile)
+	}
+
+	return pool, nil
+}
+
+func verifiedClientCertificate(conn *tls.Conn) (*x509.Certificate, error) {
+	conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if err := conn.Handshake(); err != nil {
+		return nil, err
+	}
+
+	state := conn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil, nil
+	}
+
+	return state.VerifiedChains[0][0], nil
+}
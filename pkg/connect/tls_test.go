@@ -0,0 +1,242 @@
+package connect
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCertificates struct {
+	dir string
+
+	caFile         string
+	serverCertFile string
+	serverKeyFile  string
+	clientCertFile string
+	clientKeyFile  string
+}
+
+func generateTestCertificates(t *testing.T) *testCertificates {
+	dir, err := ioutil.TempDir("", "docker-filter-tls")
+	if err != nil {
+		t.Fatal("Failed to create a temporary directory:", err)
+	}
+
+	writePem := func(name, blockType string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data}), 0600); err != nil {
+			t.Fatal("Failed to write", name, ":", err)
+		}
+		return path
+	}
+
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "docker-filter-test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal("Failed to create the CA:", err)
+	}
+	ca, _ := x509.ParseCertificate(caDer)
+
+	issue := func(serial int64, template *x509.Certificate, certName, keyName string) (string, string) {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+		template.SerialNumber = big.NewInt(serial)
+		template.NotBefore = time.Now().Add(-time.Hour)
+		template.NotAfter = time.Now().Add(time.Hour)
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal("Failed to create a certificate:", err)
+		}
+		keyDer, _ := x509.MarshalECPrivateKey(key)
+
+		return writePem(certName, "CERTIFICATE", der), writePem(keyName, "EC PRIVATE KEY", keyDer)
+	}
+
+	certs := &testCertificates{dir: dir, caFile: writePem("ca.pem", "CERTIFICATE", caDer)}
+
+	certs.serverCertFile, certs.serverKeyFile = issue(2, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "docker-daemon"},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, "server-cert.pem", "server-key.pem")
+
+	certs.clientCertFile, certs.clientKeyFile = issue(3, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "ci-runner", Organization: []string{"builds"}},
+		DNSNames:    []string{"runner.ci.local"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, "cert.pem", "key.pem")
+
+	return certs
+}
+
+func TestMutualTLSListener(t *testing.T) {
+	SetLogLevel(LogLevel_WARN)
+
+	certs := generateTestCertificates(t)
+	defer os.RemoveAll(certs.dir)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer server.Close()
+
+	config, err := ServerTLSConfig(TLSOptions{
+		CAFile:   certs.caFile,
+		CertFile: certs.serverCertFile,
+		KeyFile:  certs.serverKeyFile,
+		Verify:   true,
+	})
+	if err != nil {
+		t.Fatal("Failed to create the TLS configuration:", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen:", err)
+	}
+	defer listener.Close()
+
+	proxy := NewProxy(func() (net.Conn, error) {
+		return net.Dial("tcp", server.Listener.Addr().String())
+	})
+	proxy.AddTLSListener("", listener, config)
+
+	var client *ClientIdentity
+	proxy.On("GET", "/_ping", func(req *http.Request, body []byte) (*http.Request, error) {
+		client = ClientOf(req)
+		return nil, nil
+	})
+
+	go proxy.Process(context.Background())
+
+	caPool, _ := loadCertPool(certs.caFile)
+	clientCert, _ := tls.LoadX509KeyPair(certs.clientCertFile, certs.clientKeyFile)
+
+	withCertificate := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      caPool,
+		Certificates: []tls.Certificate{clientCert},
+	}}}
+
+	resp, err := withCertificate.Get("https://" + listener.Addr().String() + "/_ping")
+	if err != nil {
+		t.Fatal("Failed to send the request:", err)
+	}
+	resp.Body.Close()
+
+	if client == nil || client.CommonName != "ci-runner" || client.Subject != "CN=ci-runner,O=builds" {
+		t.Fatalf("Unexpected client identity: %+v", client)
+	}
+	if len(client.SANs) != 1 || client.SANs[0] != "runner.ci.local" {
+		t.Error("Unexpected subject alternative names:", client.SANs)
+	}
+
+	withoutCertificate := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs: caPool,
+	}}}
+
+	if resp, err := withoutCertificate.Get("https://" + listener.Addr().String() + "/_ping"); err == nil {
+		resp.Body.Close()
+		t.Error("Expected the request without a client certificate to fail")
+	}
+}
+
+func TestTLSDialer(t *testing.T) {
+	SetLogLevel(LogLevel_WARN)
+
+	certs := generateTestCertificates(t)
+	defer os.RemoveAll(certs.dir)
+
+	serverConfig, err := ServerTLSConfig(TLSOptions{
+		CAFile:   certs.caFile,
+		CertFile: certs.serverCertFile,
+		KeyFile:  certs.serverKeyFile,
+		Verify:   true,
+	})
+	if err != nil {
+		t.Fatal("Failed to create the TLS configuration:", err)
+	}
+
+	var serverName, clientName string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverName = r.TLS.ServerName
+		clientName = r.TLS.PeerCertificates[0].Subject.CommonName
+		w.Write([]byte("OK"))
+	}))
+	server.TLS = serverConfig
+	server.StartTLS()
+	defer server.Close()
+
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	dialer, err := TLSDialer("tcp://localhost:"+port, CertPathOptions(certs.dir))
+	if err != nil {
+		t.Fatal("Failed to create the dialer:", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen:", err)
+	}
+	defer listener.Close()
+
+	proxy := NewProxy(dialer)
+	proxy.AddListener("", listener)
+
+	go proxy.Process(context.Background())
+
+	resp, err := http.Get("http://" + listener.Addr().String() + "/_ping")
+	if err != nil {
+		t.Fatal("Failed to send the request:", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != "OK" {
+		t.Error("Unexpected response:", resp.Status, string(body))
+	}
+	if serverName != "localhost" {
+		t.Error("Unexpected server name indication:", serverName)
+	}
+	if clientName != "ci-runner" {
+		t.Error("Unexpected client certificate:", clientName)
+	}
+
+	untrusted := CertPathOptions(certs.dir)
+	untrusted.CAFile = ""
+
+	dialer, err = TLSDialer("tcp://localhost:"+port, untrusted)
+	if err != nil {
+		t.Fatal("Failed to create the dialer:", err)
+	}
+
+	if conn, err := dialer(); err == nil {
+		conn.Close()
+		t.Error("Expected the daemon certificate to fail verification")
+	}
+}
@@ -1,33 +1,68 @@
 package connect
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"regexp"
+	"sync"
+	"time"
 )
 
 type Proxy struct {
-	listeners []*localListener
-	dialer    func() (net.Conn, error)
-	handlers  []*handler
+	listeners  []*localListener
+	dialer     func() (net.Conn, error)
+	routes     []*route
+	aggregates []*aggregatedList
+	logger     Logger
+	metrics    *metrics
+	auditor    *auditor
+	recorder   *recorder
 
 	idx int
 
 	nonManagedResponses []string
+	maxRequestBodySize  int64
+
+	lock         sync.Mutex
+	pairs        map[*connectionPair]struct{}
+	shuttingDown bool
+
+	handlersLock sync.RWMutex
+	handlers     []*handler
 }
 
 type RequestFilterFunc func(req *http.Request, body []byte) (*http.Request, error)
 type ResponseFilterFunc func(resp *http.Response, body []byte) (*http.Response, error)
+type StreamFilterFunc func(resp *http.Response, chunk []byte) ([]byte, error)
 
 type FilterFunc RequestFilterFunc
 
 type handler struct {
+	method  string
+	path    string
 	pattern *regexp.Regexp
 
 	requestFilter  RequestFilterFunc
 	responseFilter ResponseFilterFunc
+	streamFilter   StreamFilterFunc
+	frameFilter    FrameFilterFunc
+}
+
+type route struct {
+	name   string
+	match  RouteMatcher
+	dialer func() (net.Conn, error)
+}
+
+// aggregatedList is an endpoint registered with Aggregate, listed on each of its upstreams.
+type aggregatedList struct {
+	match     RouteMatcher
+	upstreams []*Upstream
+	clients   []*http.Client
 }
 
 type localListener struct {
@@ -38,21 +73,71 @@ type localListener struct {
 type localConnection struct {
 	net.Conn
 
-	proxy *Proxy
+	proxy  *Proxy
+	client *ClientIdentity
 
 	idx       int
 	logPrefix string
 }
 
+// upstreamConn is a connection to one of the upstreams, with the reader its responses are parsed from.
+type upstreamConn struct {
+	net.Conn
+	reader *bufio.Reader
+	pipe   *io.PipeReader
+	name   string
+
+	metrics *metrics
+
+	lock   sync.Mutex
+	closed bool
+}
+
 type connectionPair struct {
-	localConn  *localConnection
-	remoteConn net.Conn
-	proxy      *Proxy
+	localConn *localConnection
+	remotes   map[*route]*upstreamConn
+	proxy     *Proxy
 
-	logPrefix string
+	connectionId int
+	requestCount int
+
+	pending chan *exchange
+
+	// the recorded exchange being replayed, instead of a client connection
+	replayed *RecordedExchange
+
+	lock     sync.Mutex
+	inFlight int
+	upgraded bool
+	closed   bool
+	done     chan struct{}
+}
+
+type exchange struct {
+	request     *http.Request
+	requestBody []byte
+	response    *http.Response
+	upstream    *upstreamConn
+	started     time.Time
+	decisions   []FilterDecision
+
+	// the status of the response from the upstream, before the response filters
+	upstreamStatus int
+
+	// the filters of the proxy at the time the request was read, used for the whole exchange
+	handlers []*handler
+
+	// the request as received and the response as read from the upstream, when recording
+	received         *RecordedRequest
+	upstreamResponse *RecordedResponse
+
+	// tells whether the response merges the lists of the upstreams, see Aggregate
+	aggregated bool
+
+	// tells whether the upstream switched to a raw stream, for requests asking for an upgrade
+	switched chan bool
 
-	upgraded      bool
-	latestRequest *http.Request
+	closeAfter bool
 }
 
 type pollResult struct {
@@ -61,8 +146,9 @@ type pollResult struct {
 }
 
 type filterFailure struct {
-	Cause    error
-	Category string
+	Cause      error
+	Category   string
+	StatusCode int
 }
 
 type CriticalFailure filterFailure
@@ -81,7 +167,7 @@ func NewCriticalFailure(cause interface{}, category string) CriticalFailure {
 	}
 
 	if asError, ok := cause.(error); ok {
-		return CriticalFailure{asError, category}
+		return CriticalFailure{Cause: asError, Category: category}
 	} else {
 		return CriticalFailure{
 			Cause:    errors.New(fmt.Sprintf("%s", cause)),
@@ -90,6 +176,12 @@ func NewCriticalFailure(cause interface{}, category string) CriticalFailure {
 	}
 }
 
+// WithStatus sets the HTTP status code of the response sent to the client, 403 by default.
+func (cf CriticalFailure) WithStatus(statusCode int) CriticalFailure {
+	cf.StatusCode = statusCode
+	return cf
+}
+
 type SoftFailure filterFailure
 
 func (sf SoftFailure) Error() string {
@@ -106,7 +198,7 @@ func NewSoftFailure(cause interface{}, category string) SoftFailure {
 	}
 
 	if asError, ok := cause.(error); ok {
-		return SoftFailure{asError, category}
+		return SoftFailure{Cause: asError, Category: category}
 	} else {
 		return SoftFailure{
 			Cause:    errors.New(fmt.Sprintf("%s", cause)),
@@ -114,3 +206,47 @@ func NewSoftFailure(cause interface{}, category string) SoftFailure {
 		}
 	}
 }
+
+// WithStatus turns the soft failure into a denial with the given HTTP status code,
+// without closing the connection like a critical failure would.
+func (sf SoftFailure) WithStatus(statusCode int) SoftFailure {
+	sf.StatusCode = statusCode
+	return sf
+}
+
+type Denial struct {
+	StatusCode int
+	Message    string
+}
+
+func (d Denial) Error() string {
+	return d.Message
+}
+
+func NewDenial(statusCode int, message interface{}) Denial {
+	if message == nil {
+		panic("no denial message given")
+	}
+
+	if asError, ok := message.(error); ok {
+		return Denial{statusCode, asError.Error()}
+	} else {
+		return Denial{statusCode, fmt.Sprintf("%s", message)}
+	}
+}
+
+type DirectResponse struct {
+	Response *http.Response
+}
+
+func (dr DirectResponse) Error() string {
+	return fmt.Sprintf("direct response: HTTP %d", dr.Response.StatusCode)
+}
+
+func NewDirectResponse(response *http.Response) DirectResponse {
+	if response == nil {
+		panic("no response given")
+	}
+
+	return DirectResponse{response}
+}
@@ -0,0 +1,106 @@
+package connect
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+)
+
+func newUpstreamConn(conn net.Conn, name string, metrics *metrics) *upstreamConn {
+	pipeReader, pipeWriter := io.Pipe()
+
+	upstream := &upstreamConn{
+		Conn:   conn,
+		reader: bufio.NewReader(pipeReader),
+		pipe:   pipeReader,
+		name:   name,
+
+		metrics: metrics,
+	}
+
+	// keep reading, so that the upstream closing an idle connection is noticed before the next request
+	go func() {
+		_, err := io.Copy(pipeWriter, &countingReader{Reader: conn, metrics: metrics})
+		upstream.markClosed()
+		conn.Close()
+
+		pipeWriter.CloseWithError(err)
+	}()
+
+	return upstream
+}
+
+func (u *upstreamConn) Write(b []byte) (int, error) {
+	n, err := u.Conn.Write(b)
+	if n > 0 {
+		u.metrics.bytes.add(float64(n), "sent")
+	}
+	return n, err
+}
+
+func (u *upstreamConn) Close() error {
+	u.pipe.Close()
+	return u.Conn.Close()
+}
+
+func (u *upstreamConn) markClosed() {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.closed = true
+}
+
+func (u *upstreamConn) isClosed() bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	return u.closed
+}
+
+// upstreamFor returns the connection to the upstream the request is routed to,
+// connecting to it on the first request, or again when the upstream has closed the previous connection.
+func (cp *connectionPair) upstreamFor(request *http.Request) (*upstreamConn, error) {
+	route := cp.proxy.routeFor(request)
+
+	cp.lock.Lock()
+	upstream, ok := cp.remotes[route]
+	cp.lock.Unlock()
+
+	if ok && !upstream.isClosed() {
+		return upstream, nil
+	}
+
+	// only the request handler adds connections, so nothing else can race to dial the same route
+	dialer, name := cp.proxy.dialer, ""
+	if route != nil {
+		dialer, name = route.dialer, route.name
+	}
+
+	conn, err := dialer()
+	if err != nil {
+		cp.proxy.metrics.dialErrors.add(1, routeLabel(name))
+		return nil, err
+	}
+
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+
+	if cp.closed {
+		conn.Close()
+		return nil, errors.New("connection closed")
+	}
+
+	// the previous connection closes itself once its responses are read
+	upstream = newUpstreamConn(conn, name, cp.proxy.metrics)
+	cp.remotes[route] = upstream
+
+	if ok {
+		cp.debug("Reconnected to the upstream", name)
+	} else {
+		cp.debug("Connected to the upstream", name)
+	}
+
+	return upstream, nil
+}
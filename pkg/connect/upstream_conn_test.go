@@ -0,0 +1,161 @@
+package connect
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUpstreamIsDialedAfterRequestFilters(t *testing.T) {
+	SetLogLevel(LogLevel_ERROR)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer server.Close()
+
+	var dials int32
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen:", err)
+	}
+	defer listener.Close()
+
+	proxy := NewProxy(func() (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return net.Dial("tcp", server.Listener.Addr().String())
+	})
+	proxy.AddListener("", listener)
+
+	proxy.On("*", "/secrets{rest:.*}", func(req *http.Request, body []byte) (*http.Request, error) {
+		return nil, NewDenial(http.StatusForbidden, errors.New("no secrets"))
+	})
+
+	go proxy.Process(context.Background())
+
+	for idx := 0; idx < 5; idx++ {
+		resp, err := http.Get("http://" + listener.Addr().String() + "/secrets")
+		if err != nil {
+			t.Fatal("Failed to send the request:", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusForbidden {
+			t.Error("Unexpected response:", resp.Status)
+		}
+	}
+
+	if count := atomic.LoadInt32(&dials); count != 0 {
+		t.Error("Expected no connections to the upstream for denied requests, got:", count)
+	}
+
+	resp, err := http.Get("http://" + listener.Addr().String() + "/info")
+	if err != nil {
+		t.Fatal("Failed to send the request:", err)
+	}
+	resp.Body.Close()
+
+	if count := atomic.LoadInt32(&dials); count != 1 {
+		t.Error("Expected one connection to the upstream, got:", count)
+	}
+}
+
+func TestUpstreamIsRedialedWhenClosed(t *testing.T) {
+	SetLogLevel(LogLevel_ERROR)
+
+	// answers a single request on every connection, then closes it like an idle timeout would
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen:", err)
+	}
+	defer upstream.Close()
+
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				if request, err := http.ReadRequest(bufio.NewReader(conn)); err == nil {
+					response := NewResponse(http.StatusOK, "text/plain", []byte("idle:"+request.URL.Path))
+					response.Write(conn)
+				}
+			}()
+		}
+	}()
+
+	// announces that it closes the connection after every response
+	closing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "close")
+		w.Write([]byte("closing:" + r.URL.Path))
+	}))
+	defer closing.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen:", err)
+	}
+	defer listener.Close()
+
+	var upstreamDials int32
+
+	proxy := NewProxy(func() (net.Conn, error) {
+		atomic.AddInt32(&upstreamDials, 1)
+		return net.Dial("tcp", upstream.Addr().String())
+	})
+	proxy.AddListener("", listener)
+
+	proxy.Route("closing", RouteByPathPrefix("/closing"), func() (net.Conn, error) {
+		atomic.AddInt32(&upstreamDials, 1)
+		return net.Dial("tcp", closing.Listener.Addr().String())
+	})
+
+	go proxy.Process(context.Background())
+
+	var clientDials int32
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&clientDials, 1)
+			return net.Dial(network, addr)
+		},
+	}}
+
+	for _, path := range []string{"/info", "/closing/1", "/version", "/closing/2", "/info"} {
+		resp, err := client.Get("http://" + listener.Addr().String() + path)
+		if err != nil {
+			t.Fatal("Failed to send the request:", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if string(body) != "idle:"+path && string(body) != "closing:"+path {
+			t.Error("Unexpected response:", resp.Status, string(body))
+		}
+		if resp.Close {
+			t.Error("Expected the client connection to be kept alive for", path)
+		}
+
+		// let the idle upstream connection close before the next request
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if count := atomic.LoadInt32(&clientDials); count != 1 {
+		t.Error("Expected a single client connection, got:", count)
+	}
+	if count := atomic.LoadInt32(&upstreamDials); count != 5 {
+		t.Error("Expected a new upstream connection for every request, got:", count)
+	}
+}
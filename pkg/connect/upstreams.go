@@ -0,0 +1,287 @@
+package connect
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultHealthCheckTimeout = 5 * time.Second
+	defaultRetryInterval      = 30 * time.Second
+)
+
+// Upstream is a daemon the proxy can forward to as part of an UpstreamPool.
+type Upstream struct {
+	Name   string
+	Dialer func() (net.Conn, error)
+
+	lock      sync.Mutex
+	healthy   bool
+	lastError error
+	failedAt  time.Time
+
+	// used for the aggregated list requests
+	client *http.Client
+}
+
+func NewUpstream(name string, dialer func() (net.Conn, error)) *Upstream {
+	return &Upstream{Name: name, Dialer: dialer, healthy: true}
+}
+
+// Healthy tells whether the last health check or connection attempt succeeded.
+func (u *Upstream) Healthy() bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	return u.healthy
+}
+
+// LastError returns the reason the upstream is considered unhealthy, if it is.
+func (u *Upstream) LastError() error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	return u.lastError
+}
+
+func (u *Upstream) setHealth(err error) (changed bool) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	changed = u.healthy != (err == nil)
+	u.healthy, u.lastError = err == nil, err
+
+	if err != nil {
+		u.failedAt = time.Now()
+	}
+
+	return changed
+}
+
+// retryDue tells whether the upstream failed long enough ago to try connecting to it again,
+// like a healthy one, so it can recover without health checks.
+func (u *Upstream) retryDue(interval time.Duration) bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	return !u.healthy && interval > 0 && time.Since(u.failedAt) >= interval
+}
+
+// SelectionStrategy orders the upstreams to try for a new connection, the healthy ones are
+// passed to it first, and the unhealthy ones only as a last resort when none of those connect.
+type SelectionStrategy func(candidates []*Upstream) []*Upstream
+
+// PriorityOrder tries the upstreams in the order they were given to the pool,
+// so the first healthy one gets all the connections.
+func PriorityOrder() SelectionStrategy {
+	return func(candidates []*Upstream) []*Upstream {
+		return candidates
+	}
+}
+
+// RoundRobin spreads the connections across the upstreams, one after the other.
+func RoundRobin() SelectionStrategy {
+	var counter uint64
+
+	return func(candidates []*Upstream) []*Upstream {
+		if len(candidates) == 0 {
+			return candidates
+		}
+
+		return rotate(candidates, int(atomic.AddUint64(&counter, 1)-1)%len(candidates))
+	}
+}
+
+// Random picks the first upstream to try randomly.
+func Random() SelectionStrategy {
+	return func(candidates []*Upstream) []*Upstream {
+		if len(candidates) == 0 {
+			return candidates
+		}
+
+		return rotate(candidates, rand.Intn(len(candidates)))
+	}
+}
+
+func rotate(candidates []*Upstream, start int) []*Upstream {
+	rotated := make([]*Upstream, 0, len(candidates))
+	return append(append(rotated, candidates[start:]...), candidates[:start]...)
+}
+
+// UpstreamPool dials one of several upstream daemons, failing over to the next one
+// when a connection fails, and its Dial method can be passed to NewProxy as the dialer.
+type UpstreamPool struct {
+	upstreams []*Upstream
+	strategy  SelectionStrategy
+
+	HealthCheckTimeout time.Duration
+
+	// RetryInterval is the time after a failure when an unhealthy upstream is tried again
+	// in its usual order, not only as a last resort, zero disables the retries
+	RetryInterval time.Duration
+
+	// Logger receives the health changes of the upstreams, the default logger of the proxies if not set
+	Logger Logger
+}
+
+func NewUpstreamPool(strategy SelectionStrategy, upstreams ...*Upstream) *UpstreamPool {
+	if strategy == nil {
+		strategy = PriorityOrder()
+	}
+
+	return &UpstreamPool{
+		upstreams: upstreams,
+		strategy:  strategy,
+
+		HealthCheckTimeout: defaultHealthCheckTimeout,
+		RetryInterval:      defaultRetryInterval,
+	}
+}
+
+// Upstreams returns the upstreams of the pool in the order they were given.
+func (p *UpstreamPool) Upstreams() []*Upstream {
+	return append([]*Upstream{}, p.upstreams...)
+}
+
+// Dial connects to the first upstream the strategy selects that accepts the connection.
+func (p *UpstreamPool) Dial() (net.Conn, error) {
+	var healthy, unhealthy []*Upstream
+	for _, upstream := range p.upstreams {
+		if upstream.Healthy() || upstream.retryDue(p.RetryInterval) {
+			healthy = append(healthy, upstream)
+		} else {
+			unhealthy = append(unhealthy, upstream)
+		}
+	}
+
+	var failures []string
+
+	for _, candidates := range [][]*Upstream{healthy, unhealthy} {
+		for _, upstream := range p.strategy(candidates) {
+			conn, err := upstream.Dialer()
+			if err == nil {
+				if upstream.setHealth(nil) {
+					p.log(LogLevel_INFO, upstream, "Upstream", upstream.Name, "is healthy again")
+				}
+
+				return conn, nil
+			}
+
+			if upstream.setHealth(err) {
+				p.log(LogLevel_WARN, upstream, "Failed to connect to", upstream.Name, ":", err)
+			}
+
+			failures = append(failures, upstream.Name+": "+err.Error())
+		}
+	}
+
+	if len(failures) == 0 {
+		return nil, errors.New("no upstreams configured")
+	}
+
+	return nil, errors.New("no upstreams available (" + strings.Join(failures, ", ") + ")")
+}
+
+// RunHealthChecks checks the health of the upstreams periodically until the context is done.
+func (p *UpstreamPool) RunHealthChecks(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		p.CheckHealth()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CheckHealth sends a /_ping request to every upstream and waits for the results.
+func (p *UpstreamPool) CheckHealth() {
+	var wg sync.WaitGroup
+
+	for _, upstream := range p.upstreams {
+		wg.Add(1)
+
+		go func(upstream *Upstream) {
+			defer wg.Done()
+
+			err := p.ping(upstream)
+			if upstream.setHealth(err) {
+				if err != nil {
+					p.log(LogLevel_WARN, upstream, "Upstream", upstream.Name, "is unhealthy:", err)
+				} else {
+					p.log(LogLevel_INFO, upstream, "Upstream", upstream.Name, "is healthy again")
+				}
+			}
+		}(upstream)
+	}
+
+	wg.Wait()
+}
+
+func (p *UpstreamPool) ping(upstream *Upstream) error {
+	result := make(chan error, 1)
+
+	go func() {
+		conn, err := upstream.Dialer()
+		if err != nil {
+			result <- err
+			return
+		}
+
+		// not every connection supports deadlines, closing it stops the check
+		timer := time.AfterFunc(p.HealthCheckTimeout, func() { conn.Close() })
+		defer timer.Stop()
+		defer conn.Close()
+
+		request, _ := http.NewRequest("GET", "http://docker/_ping", nil)
+		request.Close = true
+
+		if err := request.Write(conn); err != nil {
+			result <- err
+			return
+		}
+
+		response, err := http.ReadResponse(bufio.NewReader(conn), request)
+		if err != nil {
+			result <- err
+			return
+		}
+		response.Body.Close()
+
+		if response.StatusCode != http.StatusOK {
+			result <- fmt.Errorf("unexpected /_ping response: %s", response.Status)
+			return
+		}
+
+		result <- nil
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(p.HealthCheckTimeout):
+		return errors.New("health check timed out")
+	}
+}
+
+func (p *UpstreamPool) log(level int, upstream *Upstream, v ...interface{}) {
+	logger := p.Logger
+	if logger == nil {
+		logger = defaultLogger
+	}
+
+	logger.Log(level, strings.TrimSuffix(fmt.Sprintln(v...), "\n"), Fields{"upstream": upstream.Name})
+}
@@ -0,0 +1,216 @@
+package connect
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func startTestUpstream(name string, healthy *bool) (*httptest.Server, *Upstream) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_ping" && healthy != nil && !*healthy {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Write([]byte(name))
+	}))
+
+	return server, NewUpstream(name, func() (net.Conn, error) {
+		return net.Dial("tcp", server.Listener.Addr().String())
+	})
+}
+
+// failWhen makes the connections to the upstream fail while down is set.
+func failWhen(upstream *Upstream, down *bool) {
+	dial := upstream.Dialer
+
+	upstream.Dialer = func() (net.Conn, error) {
+		if *down {
+			return nil, errors.New(upstream.Name + " is down")
+		}
+		return dial()
+	}
+}
+
+func TestUpstreamFailover(t *testing.T) {
+	SetLogLevel(LogLevel_ERROR)
+
+	firstServer, first := startTestUpstream("first", nil)
+	defer firstServer.Close()
+
+	secondHealthy := true
+	secondServer, second := startTestUpstream("second", &secondHealthy)
+	defer secondServer.Close()
+
+	thirdServer, third := startTestUpstream("third", nil)
+	defer thirdServer.Close()
+
+	pool := NewUpstreamPool(PriorityOrder(), first, second, third)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen:", err)
+	}
+	defer listener.Close()
+
+	proxy := NewProxy(pool.Dial)
+	proxy.AddListener("", listener)
+
+	go proxy.Process(context.Background())
+
+	expectUpstream := func(expected string) {
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+		resp, err := client.Get("http://" + listener.Addr().String() + "/info")
+		if err != nil {
+			t.Fatal("Failed to send the request:", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if string(body) != expected {
+			t.Errorf("Expected the request to go to %s, got: %s %s", expected, resp.Status, body)
+		}
+	}
+
+	expectUpstream("first")
+
+	// fail over to the next upstream when the connection fails
+	firstServer.Close()
+	expectUpstream("second")
+
+	if first.Healthy() || first.LastError() == nil {
+		t.Error("Expected the first upstream to be unhealthy")
+	}
+
+	// skip upstreams failing their health check
+	secondHealthy = false
+	pool.CheckHealth()
+
+	if second.Healthy() || !third.Healthy() {
+		t.Error("Unexpected health after the check:", second.Healthy(), third.Healthy())
+	}
+
+	expectUpstream("third")
+
+	secondHealthy = true
+	pool.CheckHealth()
+
+	expectUpstream("second")
+}
+
+func TestUpstreamRecovery(t *testing.T) {
+	SetLogLevel(LogLevel_ERROR)
+
+	primaryServer, primary := startTestUpstream("primary", nil)
+	defer primaryServer.Close()
+
+	secondaryServer, secondary := startTestUpstream("secondary", nil)
+	defer secondaryServer.Close()
+
+	primaryDown := true
+	failWhen(primary, &primaryDown)
+
+	pool := NewUpstreamPool(PriorityOrder(), primary, secondary)
+	pool.RetryInterval = 0
+
+	expectUpstream := func(expected *httptest.Server) {
+		conn, err := pool.Dial()
+		if err != nil {
+			t.Fatal("Failed to connect:", err)
+		}
+		defer conn.Close()
+
+		if conn.RemoteAddr().String() != expected.Listener.Addr().String() {
+			t.Error("Connected to an unexpected upstream:", conn.RemoteAddr())
+		}
+	}
+
+	expectUpstream(secondaryServer)
+
+	if primary.Healthy() {
+		t.Error("Expected the primary upstream to be unhealthy")
+	}
+
+	// without retries, the unhealthy upstream is only tried when the others fail
+	primaryDown = false
+	expectUpstream(secondaryServer)
+
+	secondaryServer.Close()
+	expectUpstream(primaryServer)
+
+	if !primary.Healthy() || primary.LastError() != nil {
+		t.Error("Expected the primary upstream to be healthy after connecting to it:", primary.LastError())
+	}
+}
+
+func TestUpstreamRetry(t *testing.T) {
+	SetLogLevel(LogLevel_ERROR)
+
+	primaryServer, primary := startTestUpstream("primary", nil)
+	defer primaryServer.Close()
+
+	secondaryServer, secondary := startTestUpstream("secondary", nil)
+	defer secondaryServer.Close()
+
+	primaryDown := true
+	failWhen(primary, &primaryDown)
+
+	pool := NewUpstreamPool(PriorityOrder(), primary, secondary)
+	pool.RetryInterval = 50 * time.Millisecond
+
+	dial := func() string {
+		conn, err := pool.Dial()
+		if err != nil {
+			t.Fatal("Failed to connect:", err)
+		}
+		defer conn.Close()
+
+		return conn.RemoteAddr().String()
+	}
+
+	if dial() != secondaryServer.Listener.Addr().String() || primary.Healthy() {
+		t.Error("Expected to fail over to the secondary upstream")
+	}
+
+	primaryDown = false
+
+	if dial() != secondaryServer.Listener.Addr().String() {
+		t.Error("Expected the primary upstream not to be retried before the retry interval")
+	}
+
+	time.Sleep(pool.RetryInterval)
+
+	if dial() != primaryServer.Listener.Addr().String() {
+		t.Error("Expected the primary upstream to be preferred again after it recovered")
+	}
+
+	if !primary.Healthy() {
+		t.Error("Expected the primary upstream to be healthy after connecting to it")
+	}
+}
+
+func TestUpstreamSelectionStrategies(t *testing.T) {
+	upstreams := []*Upstream{{Name: "a"}, {Name: "b"}, {Name: "c"}}
+
+	roundRobin := RoundRobin()
+	for _, expected := range []string{"a", "b", "c", "a"} {
+		if selected := roundRobin(upstreams); selected[0].Name != expected || len(selected) != 3 {
+			t.Error("Unexpected round robin selection:", selected[0].Name, "expected:", expected)
+		}
+	}
+
+	if selected := Random()(upstreams); len(selected) != 3 {
+		t.Error("Expected every upstream to be tried:", len(selected))
+	}
+
+	if upstreams[0].Name != "a" || upstreams[1].Name != "b" || upstreams[2].Name != "c" {
+		t.Error("Expected the upstreams to be left unchanged")
+	}
+}